@@ -1,5 +1,12 @@
 package deepbooru
 
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidAccessLevel = errors.New("invalid access level")
+
 type AccessLevel int8
 
 const (
@@ -10,6 +17,40 @@ const (
 	LevelAdmin
 )
 
+func ParseAccessLevel(s string) (AccessLevel, error) {
+	switch s {
+	case "anonymous":
+		return LevelAnonymous, nil
+	case "user":
+		return LevelUser, nil
+	case "power-user":
+		return LevelPowerUser, nil
+	case "mod":
+		return LevelMod, nil
+	case "admin":
+		return LevelAdmin, nil
+	}
+
+	return LevelAnonymous, fmt.Errorf("%w: %q", ErrInvalidAccessLevel, s)
+}
+
+func (l AccessLevel) String() string {
+	switch l {
+	case LevelAnonymous:
+		return "anonymous"
+	case LevelUser:
+		return "user"
+	case LevelPowerUser:
+		return "power-user"
+	case LevelMod:
+		return "mod"
+	case LevelAdmin:
+		return "admin"
+	default:
+		return fmt.Sprintf("level %d", int8(l))
+	}
+}
+
 type Auth struct {
 	ID    string
 	Name  string
@@ -0,0 +1,420 @@
+package deepbooru
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const DefaultScaleInterval = 10 * time.Second
+const DefaultIdleTimeout = 5 * time.Minute
+const DefaultWarmupTimeout = 5 * time.Minute
+const DefaultScalePressure = 0.1
+
+type Member interface {
+	Processor
+	Memory() uint64
+	Stop()
+}
+
+type MemberFactory func() (Member, error)
+
+type AutoscalingProcessor struct {
+	sync.Mutex
+
+	Factory MemberFactory
+	Min     int
+	Max     int
+
+	MemoryBudget  uint64
+	Pressure      float64
+	ScaleInterval time.Duration
+	IdleTimeout   time.Duration
+	WarmupTimeout time.Duration
+
+	members  []*poolMember
+	spawning int
+	calls    int
+	waits    int
+	changed  chan struct{}
+	ctx      context.Context
+	now      func() time.Time
+}
+
+type poolMember struct {
+	Member
+
+	inUse    int
+	slots    int
+	lastUsed time.Time
+	unready  time.Time
+}
+
+func (m *poolMember) free() int {
+	if m.inUse == 0 {
+		m.slots = m.Capacity()
+
+		if m.slots < 1 {
+			m.slots = 1
+		}
+	}
+
+	return m.slots - m.inUse
+}
+
+func (ap *AutoscalingProcessor) Run(ctx context.Context) error {
+	ap.Lock()
+
+	if ap.ctx != nil {
+		ap.Unlock()
+
+		return ErrAlreadyRunning
+	}
+
+	ap.ctx = ctx
+
+	if ap.now == nil {
+		ap.now = time.Now
+	}
+
+	ap.Unlock()
+
+	interval := ap.ScaleInterval
+
+	if interval <= 0 {
+		interval = DefaultScaleInterval
+	}
+
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	ap.scale()
+
+	for {
+		select {
+		case <-ctx.Done():
+			ap.stop()
+
+			return nil
+		case <-ticker.C:
+			ap.scale()
+		}
+	}
+}
+
+func (ap *AutoscalingProcessor) scale() {
+	ap.Lock()
+	defer ap.Unlock()
+
+	size := len(ap.members) + ap.spawning
+	pressure := 0.0
+
+	if ap.calls > 0 {
+		pressure = float64(ap.waits) / float64(ap.calls)
+	}
+
+	threshold := ap.Pressure
+
+	if threshold <= 0 {
+		threshold = DefaultScalePressure
+	}
+
+	ap.calls, ap.waits = 0, 0
+
+	for evicted := ap.evict(); evicted > 0; evicted-- {
+		ap.spawn()
+	}
+
+	switch {
+	case size < ap.Min:
+		for ; size < ap.Min; size++ {
+			ap.spawn()
+		}
+	case pressure >= threshold && size < ap.Max && ap.spawning == 0:
+		if !ap.memoryAllows() {
+			log.Printf("Pool is under pressure (%.2f), but the memory budget is exhausted", pressure)
+
+			return
+		}
+
+		log.Printf("Pool is under pressure (%.2f), growing to %d", pressure, size+1)
+		ap.spawn()
+	case size > ap.Min:
+		ap.shrink()
+	}
+}
+
+func (ap *AutoscalingProcessor) memoryAllows() bool {
+	if ap.MemoryBudget == 0 {
+		return true
+	}
+
+	var used, largest uint64
+
+	for _, m := range ap.members {
+		memory := m.Memory()
+		used += memory
+
+		if memory > largest {
+			largest = memory
+		}
+	}
+
+	return used+largest <= ap.MemoryBudget
+}
+
+func (ap *AutoscalingProcessor) spawn() {
+	ctx := ap.ctx
+	ap.spawning++
+
+	go func() {
+		m := ap.warmUp(ctx)
+
+		ap.Lock()
+		ap.spawning--
+
+		if m != nil && ap.ctx != ctx {
+			ap.Unlock()
+			m.Stop()
+
+			return
+		}
+
+		if m != nil {
+			ap.members = append(ap.members, &poolMember{Member: m, lastUsed: ap.now()})
+			ap.notify()
+		}
+
+		ap.Unlock()
+	}()
+}
+
+func (ap *AutoscalingProcessor) warmUp(ctx context.Context) Member {
+	m, err := ap.Factory()
+
+	if err != nil {
+		log.Printf("Failed to spawn pool member: %s", err)
+
+		return nil
+	}
+
+	timeout := ap.warmupTimeout()
+	deadline := time.NewTimer(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+
+	defer deadline.Stop()
+	defer ticker.Stop()
+
+	for !m.IsReady() {
+		select {
+		case <-ctx.Done():
+			m.Stop()
+
+			return nil
+		case <-deadline.C:
+			log.Printf("Pool member did not become ready within %s", timeout)
+			m.Stop()
+
+			return nil
+		case <-ticker.C:
+		}
+	}
+
+	return m
+}
+
+func (ap *AutoscalingProcessor) warmupTimeout() time.Duration {
+	if ap.WarmupTimeout <= 0 {
+		return DefaultWarmupTimeout
+	}
+
+	return ap.WarmupTimeout
+}
+
+func (ap *AutoscalingProcessor) evict() int {
+	timeout := ap.warmupTimeout()
+	now := ap.now()
+	members := ap.members[:0]
+	evicted := 0
+
+	for _, m := range ap.members {
+		switch {
+		case m.IsReady():
+			m.unready = time.Time{}
+		case m.unready.IsZero():
+			m.unready = now
+		case now.Sub(m.unready) >= timeout:
+			log.Printf("Pool member not ready for %s, replacing it", now.Sub(m.unready))
+
+			evicted++
+
+			go m.Stop()
+
+			continue
+		}
+
+		members = append(members, m)
+	}
+
+	for i := len(members); i < len(ap.members); i++ {
+		ap.members[i] = nil
+	}
+
+	ap.members = members
+
+	return evicted
+}
+
+func (ap *AutoscalingProcessor) shrink() {
+	idleTimeout := ap.IdleTimeout
+
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+
+	now := ap.now()
+
+	for i, m := range ap.members {
+		if m.inUse > 0 || now.Sub(m.lastUsed) < idleTimeout {
+			continue
+		}
+
+		log.Printf("Pool member idle for %s, shrinking to %d", now.Sub(m.lastUsed), len(ap.members)-1)
+
+		ap.members = append(ap.members[:i], ap.members[i+1:]...)
+
+		go m.Stop()
+
+		return
+	}
+}
+
+func (ap *AutoscalingProcessor) stop() {
+	ap.Lock()
+	members := ap.members
+	ap.members = nil
+	ap.ctx = nil
+	ap.notify()
+	ap.Unlock()
+
+	var wg sync.WaitGroup
+
+	for _, m := range members {
+		wg.Add(1)
+
+		go func(m *poolMember) {
+			defer wg.Done()
+
+			m.Stop()
+		}(m)
+	}
+
+	wg.Wait()
+}
+
+func (ap *AutoscalingProcessor) notify() {
+	if ap.changed != nil {
+		close(ap.changed)
+		ap.changed = nil
+	}
+}
+
+func (ap *AutoscalingProcessor) acquire(global, local context.Context) (*poolMember, error) {
+	waited := false
+
+	ap.Lock()
+	ap.calls++
+	ap.Unlock()
+
+	for {
+		ap.Lock()
+
+		for _, m := range ap.members {
+			if m.IsReady() && m.free() > 0 {
+				m.inUse++
+				ap.Unlock()
+
+				return m, nil
+			}
+		}
+
+		if !waited {
+			ap.waits++
+			waited = true
+		}
+
+		if ap.changed == nil {
+			ap.changed = make(chan struct{})
+		}
+
+		changed := ap.changed
+
+		ap.Unlock()
+
+		select {
+		case <-global.Done():
+			return nil, ErrTerminated
+		case <-local.Done():
+			return nil, ErrCancelled
+		case <-changed:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (ap *AutoscalingProcessor) release(m *poolMember) {
+	ap.Lock()
+	m.inUse--
+	m.lastUsed = ap.now()
+	ap.notify()
+	ap.Unlock()
+}
+
+func (ap *AutoscalingProcessor) Process(global, local context.Context, timeout time.Duration, url string) ([]Tag, error) {
+	m, err := ap.acquire(global, local)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer ap.release(m)
+
+	return m.Process(global, local, timeout, url)
+}
+
+func (ap *AutoscalingProcessor) Capacity() int {
+	ap.Lock()
+	defer ap.Unlock()
+
+	free := 0
+
+	for _, m := range ap.members {
+		if m.IsReady() {
+			free += m.free()
+		}
+	}
+
+	return free
+}
+
+func (ap *AutoscalingProcessor) IsReady() bool {
+	ap.Lock()
+	defer ap.Unlock()
+
+	for _, m := range ap.members {
+		if m.IsReady() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ap *AutoscalingProcessor) Size() int {
+	ap.Lock()
+	defer ap.Unlock()
+
+	return len(ap.members)
+}
@@ -0,0 +1,323 @@
+package deepbooru
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testMember struct {
+	sync.Mutex
+
+	memory  uint64
+	slots   int
+	ready   bool
+	stopped bool
+	release chan struct{}
+}
+
+func (m *testMember) Process(global, local context.Context, timeout time.Duration, url string) ([]Tag, error) {
+	select {
+	case <-m.release:
+		return []Tag{{Name: url, Score: 1}}, nil
+	case <-local.Done():
+		return nil, ErrCancelled
+	}
+}
+
+func (m *testMember) Capacity() int {
+	if m.slots > 0 {
+		return m.slots
+	}
+
+	return 1
+}
+
+func (m *testMember) IsReady() bool {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.ready && !m.stopped
+}
+
+func (m *testMember) Memory() uint64 {
+	return m.memory
+}
+
+func (m *testMember) Stop() {
+	m.Lock()
+	m.stopped = true
+	m.Unlock()
+}
+
+type testMemberFactory struct {
+	sync.Mutex
+
+	members []*testMember
+	memory  uint64
+	slots   int
+	release chan struct{}
+}
+
+func (f *testMemberFactory) spawn() (Member, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	m := &testMember{memory: f.memory, slots: f.slots, ready: true, release: f.release}
+	f.members = append(f.members, m)
+
+	return m, nil
+}
+
+func (f *testMemberFactory) stopped() int {
+	f.Lock()
+	defer f.Unlock()
+
+	stopped := 0
+
+	for _, m := range f.members {
+		m.Lock()
+
+		if m.stopped {
+			stopped++
+		}
+
+		m.Unlock()
+	}
+
+	return stopped
+}
+
+func waitUntil(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return false
+}
+
+func startAutoscaling(t *testing.T, ap *AutoscalingProcessor) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		ap.Run(ctx)
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestAutoscalingProcessorGrow(t *testing.T) {
+	f := &testMemberFactory{release: make(chan struct{})}
+	ap := &AutoscalingProcessor{
+		Factory:       f.spawn,
+		Min:           1,
+		Max:           2,
+		ScaleInterval: 10 * time.Millisecond,
+		IdleTimeout:   time.Hour,
+	}
+
+	startAutoscaling(t, ap)
+
+	if !waitUntil(func() bool { return ap.Capacity() == 1 }) {
+		t.Fatalf("capacity: %d; expected: 1", ap.Capacity())
+	}
+
+	results := make(chan error, 3)
+
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := ap.Process(context.Background(), context.Background(), 0, "test")
+			results <- err
+		}()
+	}
+
+	if !waitUntil(func() bool { return ap.Size() == 2 }) {
+		t.Fatalf("size: %d; expected the pool to grow to 2", ap.Size())
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if size := ap.Size(); size != 2 {
+		t.Errorf("size: %d; expected the pool to stop at max", size)
+	}
+
+	for i := 0; i < 3; i++ {
+		f.release <- struct{}{}
+
+		if err := <-results; err != nil {
+			t.Errorf("err: %s", err)
+		}
+	}
+}
+
+func TestAutoscalingProcessorMemoryBudget(t *testing.T) {
+	f := &testMemberFactory{memory: 600, release: make(chan struct{})}
+	ap := &AutoscalingProcessor{
+		Factory:       f.spawn,
+		Min:           1,
+		Max:           3,
+		MemoryBudget:  1000,
+		ScaleInterval: 10 * time.Millisecond,
+		IdleTimeout:   time.Hour,
+	}
+
+	startAutoscaling(t, ap)
+
+	if !waitUntil(func() bool { return ap.Size() == 1 }) {
+		t.Fatalf("size: %d; expected: 1", ap.Size())
+	}
+
+	results := make(chan error, 2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := ap.Process(context.Background(), context.Background(), 0, "test")
+			results <- err
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if size := ap.Size(); size != 1 {
+		t.Errorf("size: %d; expected the memory budget to prevent growth", size)
+	}
+
+	for i := 0; i < 2; i++ {
+		f.release <- struct{}{}
+		<-results
+	}
+}
+
+func TestAutoscalingProcessorShrink(t *testing.T) {
+	f := &testMemberFactory{release: make(chan struct{})}
+	ap := &AutoscalingProcessor{
+		Factory:       f.spawn,
+		Min:           2,
+		Max:           2,
+		ScaleInterval: 10 * time.Millisecond,
+		IdleTimeout:   20 * time.Millisecond,
+	}
+
+	startAutoscaling(t, ap)
+
+	if !waitUntil(func() bool { return ap.Size() == 2 }) {
+		t.Fatalf("size: %d; expected: 2", ap.Size())
+	}
+
+	ap.Lock()
+	ap.Min = 1
+	ap.Unlock()
+
+	if !waitUntil(func() bool { return ap.Size() == 1 && f.stopped() == 1 }) {
+		t.Errorf("size: %d, stopped: %d; expected the pool to shrink to 1", ap.Size(), f.stopped())
+	}
+}
+
+func TestAutoscalingProcessorCancelWait(t *testing.T) {
+	f := &testMemberFactory{release: make(chan struct{})}
+	ap := &AutoscalingProcessor{
+		Factory:       f.spawn,
+		Min:           1,
+		Max:           1,
+		ScaleInterval: 10 * time.Millisecond,
+	}
+
+	startAutoscaling(t, ap)
+
+	if !waitUntil(func() bool { return ap.Capacity() == 1 }) {
+		t.Fatalf("capacity: %d; expected: 1", ap.Capacity())
+	}
+
+	go ap.Process(context.Background(), context.Background(), 0, "busy")
+
+	if !waitUntil(func() bool { return ap.Capacity() == 0 }) {
+		t.Fatalf("capacity: %d; expected: 0", ap.Capacity())
+	}
+
+	local, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := ap.Process(context.Background(), local, 0, "waiting"); err != ErrCancelled {
+		t.Errorf("err: %v; expected: ErrCancelled", err)
+	}
+
+	f.release <- struct{}{}
+}
+
+func TestAutoscalingProcessorMemberCapacity(t *testing.T) {
+	f := &testMemberFactory{slots: 3, release: make(chan struct{})}
+	ap := &AutoscalingProcessor{
+		Factory:       f.spawn,
+		Min:           1,
+		Max:           1,
+		ScaleInterval: 10 * time.Millisecond,
+	}
+
+	startAutoscaling(t, ap)
+
+	if !waitUntil(func() bool { return ap.Capacity() == 3 }) {
+		t.Fatalf("capacity: %d; expected: 3", ap.Capacity())
+	}
+
+	for i := 0; i < 3; i++ {
+		go ap.Process(context.Background(), context.Background(), 0, "busy")
+	}
+
+	if !waitUntil(func() bool { return ap.Capacity() == 0 }) {
+		t.Fatalf("capacity: %d; expected all 3 slots of the member to be used", ap.Capacity())
+	}
+
+	for i := 0; i < 3; i++ {
+		f.release <- struct{}{}
+	}
+
+	if !waitUntil(func() bool { return ap.Capacity() == 3 }) {
+		t.Errorf("capacity: %d; expected: 3", ap.Capacity())
+	}
+}
+
+func TestAutoscalingProcessorReplaceUnready(t *testing.T) {
+	f := &testMemberFactory{release: make(chan struct{})}
+	ap := &AutoscalingProcessor{
+		Factory:       f.spawn,
+		Min:           1,
+		Max:           1,
+		ScaleInterval: 10 * time.Millisecond,
+		IdleTimeout:   time.Hour,
+		WarmupTimeout: 20 * time.Millisecond,
+	}
+
+	startAutoscaling(t, ap)
+
+	if !waitUntil(func() bool { return ap.Capacity() == 1 }) {
+		t.Fatalf("capacity: %d; expected: 1", ap.Capacity())
+	}
+
+	f.Lock()
+	dead := f.members[0]
+	f.Unlock()
+
+	dead.Lock()
+	dead.ready = false
+	dead.Unlock()
+
+	if !waitUntil(func() bool { return f.stopped() == 1 && ap.Capacity() == 1 }) {
+		t.Errorf("stopped: %d, capacity: %d; expected the unready member to be replaced", f.stopped(), ap.Capacity())
+	}
+
+	if size := ap.Size(); size != 1 {
+		t.Errorf("size: %d; expected: 1", size)
+	}
+}
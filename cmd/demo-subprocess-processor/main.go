@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"deepbooru/internal/nurse"
+	"deepbooru/internal/resolver"
 	"deepbooru/ipc"
 )
 
@@ -18,7 +19,7 @@ func main() {
 		return
 	}
 
-	sigs := make(chan os.Signal)
+	sigs := make(chan os.Signal, 1)
 	done := make(chan struct{})
 	ctx, cancel := context.WithCancel(context.Background())
 	var taskCtx context.Context
@@ -62,7 +63,9 @@ func main() {
 		}
 	}()
 
-	p := deepbooru_ipc.Processor{Bus: &n}
+	cwd, _ := os.Getwd()
+	r := resolver.New(resolver.Config{FileRoots: []string{cwd}})
+	p := deepbooru_ipc.Processor{Bus: &n, Resolver: r}
 	scanner := bufio.NewScanner(os.Stdin)
 
 	for scanner.Scan() {
@@ -3,18 +3,29 @@ package main
 import (
 	"context"
 	"flag"
+	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/nats-io/nats.go"
 
 	"deepbooru"
+	"deepbooru/internal/admin"
 	"deepbooru/internal/authorizer/http"
+	"deepbooru/internal/storage/memory"
 )
 
 var authorizerUrl = ""
 var databaseUrl = ""
 var natsUrl = nats.DefaultURL
+var adminAddress = ""
+var adminLevel = "admin"
+var fairQueueing = false
+var fairWeights = ""
+var agingInterval time.Duration
+var agingCap = memory_storage.DefaultAgingCap
 var minAccessLevel = deepbooru.Anonymous
 
 func getenv(name, defaultValue string) string {
@@ -29,6 +40,12 @@ func init() {
 	flag.StringVar(&authorizerUrl, "a", getenv("AUTHORIZER_URL", authorizerUrl), "Authorizer URL")
 	flag.StringVar(&databaseUrl, "d", getenv("DATABASE_URL", databaseUrl), "Database URL")
 	flag.StringVar(&natsUrl, "n", getenv("NATS_URL", natsUrl), "NATS URL")
+	flag.StringVar(&adminAddress, "admin", getenv("ADMIN_ADDRESS", adminAddress), "Serve the admin API on this address")
+	flag.StringVar(&adminLevel, "admin-level", getenv("ADMIN_LEVEL", adminLevel), "Access level required by the admin API")
+	flag.BoolVar(&fairQueueing, "fair", fairQueueing, "Share the queue fairly between submitters of the same priority")
+	flag.StringVar(&fairWeights, "fair-weights", getenv("FAIR_WEIGHTS", fairWeights), "Fair queueing weights per access level, e.g. user=2,mod=4")
+	flag.DurationVar(&agingInterval, "aging-interval", agingInterval, "Raise the priority of pending jobs by one for every interval they wait")
+	flag.IntVar(&agingCap, "aging-cap", agingCap, "The most a pending job's priority can rise by aging")
 	flag.Parse()
 }
 
@@ -49,6 +66,22 @@ func getAuthorizer(url string) (deepbooru.Authorizer, CloserFunc) {
 }
 
 func getStorage(url string) (deepbooru.Storage, CloserFunc) {
+	if url == "" || url == "memory:" {
+		weights, err := memory_storage.ParseWeights(fairWeights)
+
+		if err != nil {
+			panic(err)
+		}
+
+		storage := memory_storage.New()
+		storage.Fair = fairQueueing
+		storage.Weights = weights
+		storage.AgingInterval = agingInterval
+		storage.AgingCap = agingCap
+
+		return storage, noop
+	}
+
 	return nil, noop
 }
 
@@ -67,6 +100,25 @@ func main() {
 
 	manager := deepbooru.NewManager(authorizer, bus, storage)
 
+	if adminAddress != "" {
+		level, err := deepbooru.ParseAccessLevel(adminLevel)
+
+		if err != nil {
+			panic(err)
+		}
+
+		handler := admin.New(manager)
+		handler.Level = level
+
+		go func() {
+			err := http.ListenAndServe(adminAddress, handler)
+
+			if err != nil {
+				log.Printf("admin API failed: %s", err)
+			}
+		}()
+	}
+
 	sigs := make(chan os.Signal, 1)
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"deepbooru"
+	"deepbooru/internal/nurse"
+	"deepbooru/internal/processor/http"
+	"deepbooru/internal/processor/middleware"
+	"deepbooru/internal/resolver"
+	"deepbooru/ipc"
+)
+
+var natsUrl = nats.DefaultURL
+var nodeName, _ = os.Hostname()
+var poolSize = 1
+var maxPoolSize = 0
+var memoryBudget uint64
+var idleTimeout = deepbooru.DefaultIdleTimeout
+var startupTimeout = nurse.DefaultStartupTimeout
+var fileRoots = ""
+var connect = ""
+var modelURL = ""
+var httpMode = http_processor.ModeURL
+var httpMapping = http_processor.Mapping{}
+var httpConnections = http_processor.DefaultMaxConnections
+var batching = false
+var batchSize = 0
+var batchWindow = deepbooru_ipc.DefaultBatchWindow
+var restartPolicy = "always"
+var maxBackoff = nurse.DefaultMaxBackoff
+var restart nurse.RestartPolicy
+var limits = nurse.Limits{}
+var softMemoryLimit uint64
+var watchPath = ""
+var s3 = resolver.Config{}
+var capabilities = ""
+var exitAfterDrain = false
+var queueSize = 0
+var queueTimeout = deepbooru.DefaultQueueTimeout
+var chain = middleware.Config{}
+
+func getenv(name, defaultValue string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+
+	return defaultValue
+}
+
+func getenvInt(name string, defaultValue int) int {
+	if value, ok := os.LookupEnv(name); ok {
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	}
+
+	return defaultValue
+}
+
+func init() {
+	flag.StringVar(&natsUrl, "n", getenv("NATS_URL", natsUrl), "NATS URL")
+	flag.StringVar(&nodeName, "name", getenv("WORKER_NAME", nodeName), "Worker node name")
+	flag.IntVar(&poolSize, "p", getenvInt("POOL_SIZE", poolSize), "Number of model subprocesses")
+	flag.IntVar(&maxPoolSize, "max-pool", getenvInt("POOL_MAX", maxPoolSize), "Grow the pool up to this many model subprocesses under pressure")
+	flag.Uint64Var(&memoryBudget, "memory-budget", 0, "Don't grow the pool past this many bytes of subprocess RSS")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout, "Shrink the pool when a subprocess has been idle this long")
+	flag.DurationVar(&startupTimeout, "startup-timeout", startupTimeout, "How long to wait for a subprocess to say hello")
+	flag.StringVar(&connect, "connect", getenv("MODEL_ADDRESS", connect), "Connect to a model server at unix:/path or tcp:host:port instead of running a command")
+	flag.StringVar(&modelURL, "http", getenv("MODEL_URL", modelURL), "POST images to a model server at this URL instead of running a command")
+	flag.StringVar(&httpMode, "http-mode", getenv("MODEL_URL_MODE", httpMode), "What to POST to the model server: url or binary")
+	flag.StringVar(&httpMapping.Tags, "http-tags", getenv("MODEL_URL_TAGS", ""), "Dotted path to the tags in the model server response")
+	flag.StringVar(&httpMapping.Name, "http-tag-name", getenv("MODEL_URL_TAG_NAME", "name"), "Tag name field in the model server response")
+	flag.StringVar(&httpMapping.Score, "http-tag-score", getenv("MODEL_URL_TAG_SCORE", "score"), "Tag score field in the model server response")
+	flag.IntVar(&httpConnections, "http-connections", getenvInt("MODEL_URL_CONNECTIONS", httpConnections), "Maximum concurrent connections to the model server")
+	flag.BoolVar(&batching, "batch", batching, "Send concurrent jobs in batches to subprocesses that advertise max_batch")
+	flag.IntVar(&batchSize, "batch-size", getenvInt("BATCH_SIZE", batchSize), "Largest batch to send, defaults to the subprocess max_batch")
+	flag.DurationVar(&batchWindow, "batch-window", batchWindow, "How long to wait for a batch to fill up")
+	flag.StringVar(&restartPolicy, "restart", getenv("RESTART_POLICY", restartPolicy), "Subprocess restart policy: always, on-failure or never")
+	flag.DurationVar(&maxBackoff, "max-backoff", maxBackoff, "Maximum delay between subprocess restarts")
+	flag.Uint64Var(&limits.AddressSpace, "rlimit-as", 0, "Subprocess address space limit in bytes")
+	flag.DurationVar(&limits.CPUTime, "rlimit-cpu", 0, "Subprocess CPU time limit")
+	flag.Uint64Var(&limits.OpenFiles, "rlimit-nofile", 0, "Subprocess open files limit")
+	flag.StringVar(&limits.Cgroup, "cgroup", getenv("CGROUP", ""), "cgroup v2 directory to create subprocess cgroups in")
+	flag.Uint64Var(&limits.MemoryMax, "memory-max", 0, "Subprocess cgroup memory.max in bytes")
+	flag.Uint64Var(&softMemoryLimit, "soft-memory-limit", 0, "Recycle a subprocess between jobs when its RSS exceeds this many bytes")
+	flag.StringVar(&watchPath, "watch", getenv("MODEL_PATH", watchPath), "Reload subprocesses one by one when this file changes")
+	flag.IntVar(&chain.Retries, "retries", getenvInt("RETRIES", 0), "Retry a job this many times on transient errors")
+	flag.DurationVar(&chain.RetryBackoff, "retry-backoff", middleware.DefaultRetryBackoff, "Delay before the first retry, doubled on each attempt")
+	flag.IntVar(&chain.BreakerThreshold, "breaker-threshold", getenvInt("BREAKER_THRESHOLD", 0), "Stop taking jobs after this many consecutive failures")
+	flag.DurationVar(&chain.BreakerCooldown, "breaker-cooldown", middleware.DefaultBreakerCooldown, "How long the circuit breaker stays open")
+	flag.IntVar(&chain.CacheSize, "cache-size", getenvInt("CACHE_SIZE", 0), "Cache results for this many URLs")
+	flag.DurationVar(&chain.CacheTTL, "cache-ttl", 0, "How long cached results are valid")
+	flag.BoolVar(&chain.Metrics, "metrics", false, "Log the duration of every job")
+	flag.StringVar(&capabilities, "capabilities", getenv("CAPABILITIES", capabilities), "Comma separated capabilities jobs may require, in addition to model=name")
+	flag.IntVar(&queueSize, "queue-size", getenvInt("QUEUE_SIZE", queueSize), "How many scheduled jobs to hold locally, defaults to twice the processing slots")
+	flag.DurationVar(&queueTimeout, "queue-timeout", queueTimeout, "Return jobs to the manager after they waited this long in the local queue")
+	flag.BoolVar(&exitAfterDrain, "exit-after-drain", exitAfterDrain, "Exit once draining finishes instead of staying idle")
+	flag.StringVar(&fileRoots, "file-roots", getenv("FILE_ROOTS", fileRoots), "Directories file:// URLs may refer to (path list)")
+	flag.StringVar(&s3.S3Endpoint, "s3-endpoint", getenv("S3_ENDPOINT", ""), "S3-compatible endpoint for s3:// URLs")
+	flag.StringVar(&s3.S3Region, "s3-region", getenv("S3_REGION", "us-east-1"), "S3 region")
+	flag.Parse()
+
+	var err error
+	restart, err = nurse.ParseRestartPolicy(restartPolicy)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if httpMode != http_processor.ModeURL && httpMode != http_processor.ModeBinary {
+		log.Fatalf("invalid model server mode: %q", httpMode)
+	}
+
+	s3.S3AccessKeyID = getenv("S3_ACCESS_KEY_ID", getenv("AWS_ACCESS_KEY_ID", ""))
+	s3.S3SecretAccessKey = getenv("S3_SECRET_ACCESS_KEY", getenv("AWS_SECRET_ACCESS_KEY", ""))
+	s3.S3SessionToken = getenv("S3_SESSION_TOKEN", getenv("AWS_SESSION_TOKEN", ""))
+}
+
+type CloserFunc func()
+
+func noop() {}
+
+func getBus(url string) (deepbooru.BusFactory, CloserFunc) {
+	return nil, noop
+}
+
+func getResolver() resolver.Resolver {
+	cfg := s3
+
+	if fileRoots != "" {
+		cfg.FileRoots = filepath.SplitList(fileRoots)
+	}
+
+	return resolver.New(cfg)
+}
+
+type runner interface {
+	deepbooru_ipc.Bus
+	Run(ctx context.Context) error
+}
+
+func getModelBus() (runner, error) {
+	if connect == "" {
+		return &nurse.Nurse{
+			Path:            flag.Arg(0),
+			Args:            flag.Args()[1:],
+			Environ:         os.Environ(),
+			KillTimeout:     15 * time.Second,
+			StartupTimeout:  startupTimeout,
+			Restart:         restart,
+			MaxBackoff:      maxBackoff,
+			Limits:          limits,
+			SoftMemoryLimit: softMemoryLimit,
+		}, nil
+	}
+
+	network, address, err := deepbooru_ipc.ParseAddress(connect)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &deepbooru_ipc.ConnBus{
+		Network:      network,
+		Address:      address,
+		HelloTimeout: startupTimeout,
+	}, nil
+}
+
+type member struct {
+	deepbooru.Processor
+
+	bus    runner
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (m *member) Memory() uint64 {
+	if n, ok := m.bus.(*nurse.Nurse); ok {
+		return n.Memory()
+	}
+
+	return 0
+}
+
+func (m *member) Stop() {
+	m.cancel()
+	<-m.done
+}
+
+func memberFactory(r resolver.Resolver, pool *nurse.Pool) deepbooru.MemberFactory {
+	return func() (deepbooru.Member, error) {
+		bus, err := getModelBus()
+
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		m := &member{
+			Processor: getIPCProcessor(bus, r),
+			bus:       bus,
+			cancel:    cancel,
+			done:      make(chan struct{}),
+		}
+		n, isNurse := bus.(*nurse.Nurse)
+
+		if isNurse {
+			pool.Add(n)
+		}
+
+		go func() {
+			defer close(m.done)
+
+			err := bus.Run(ctx)
+
+			if err != nil && ctx.Err() == nil {
+				log.Printf("model bus failed: %s", err)
+			}
+
+			if isNurse {
+				pool.Remove(n)
+			}
+		}()
+
+		return m, nil
+	}
+}
+
+func getIPCProcessor(bus deepbooru_ipc.Bus, r resolver.Resolver) deepbooru.Processor {
+	p := &deepbooru_ipc.Processor{Bus: bus, Resolver: r}
+
+	if !batching {
+		return p
+	}
+
+	return &deepbooru_ipc.BatchProcessor{Processor: p, MaxItems: batchSize, Window: batchWindow}
+}
+
+func getHTTPProcessor(r resolver.Resolver) deepbooru.Processor {
+	p := http_processor.New(modelURL, httpConnections)
+	p.Mode = httpMode
+	p.Mapping = httpMapping
+	p.Resolver = r
+
+	return p
+}
+
+func main() {
+	if flag.NArg() == 0 && connect == "" && modelURL == "" {
+		fmt.Printf("Usage: %s [flags] command [args...]\n", os.Args[0])
+		flag.PrintDefaults()
+		return
+	}
+
+	bus, closeBus := getBus(natsUrl)
+
+	defer closeBus()
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	nurseCtx, nurseCancel := context.WithCancel(context.Background())
+	r := getResolver()
+	processors := make([]deepbooru.Processor, poolSize)
+	pool := &nurse.Pool{}
+
+	if maxPoolSize > poolSize || modelURL != "" {
+		processors = nil
+	}
+
+	for i := range processors {
+		n, err := getModelBus()
+
+		if err != nil {
+			log.Fatalf("invalid model address: %s", err)
+		}
+
+		processors[i] = getIPCProcessor(n, r)
+
+		if n, ok := n.(*nurse.Nurse); ok {
+			pool.Nurses = append(pool.Nurses, n)
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			err := n.Run(nurseCtx)
+
+			if err != nil {
+				log.Printf("model bus failed: %s", err)
+			}
+		}()
+	}
+
+	worker := deepbooru.NewWorker(bus)
+	worker.Name = nodeName
+	worker.ExitAfterDrain = exitAfterDrain
+	worker.QueueSize = queueSize
+	worker.QueueTimeout = queueTimeout
+
+	if capabilities != "" {
+		worker.Capabilities = strings.Split(capabilities, ",")
+	}
+	worker.Processor = deepbooru.NewPooledProcessor(processors)
+
+	if modelURL != "" {
+		worker.Processor = getHTTPProcessor(r)
+	} else if maxPoolSize > poolSize {
+		autoscaling := &deepbooru.AutoscalingProcessor{
+			Factory:       memberFactory(r, pool),
+			Min:           poolSize,
+			Max:           maxPoolSize,
+			MemoryBudget:  memoryBudget,
+			IdleTimeout:   idleTimeout,
+			WarmupTimeout: startupTimeout,
+		}
+		worker.Processor = autoscaling
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			autoscaling.Run(nurseCtx)
+		}()
+	}
+
+	if modelURL != "" {
+		chain.RetryErrors = append([]error{http_processor.ErrUnavailable}, middleware.DefaultRetryErrors...)
+	}
+
+	worker.Processor = chain.Build(worker.Processor)
+
+	if connect == "" && modelURL == "" {
+		worker.Reloader = pool
+
+		if watchPath != "" {
+			go pool.Watch(ctx, watchPath, 0)
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signals := []os.Signal{os.Interrupt, syscall.SIGHUP}
+
+	for sig := range drainSignals {
+		signals = append(signals, sig)
+	}
+
+	signal.Notify(sigs, signals...)
+
+	go func() {
+		for sig := range sigs {
+			if enable, ok := drainSignals[sig]; ok {
+				worker.OnDrain(nodeName, enable)
+
+				continue
+			}
+
+			switch sig {
+			case syscall.SIGHUP:
+				worker.OnReload(nodeName)
+			default:
+				cancel()
+
+				return
+			}
+		}
+	}()
+
+	err := worker.Run(ctx)
+
+	nurseCancel()
+	wg.Wait()
+
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var drainSignals = map[os.Signal]bool{
+	syscall.SIGUSR1: true,
+	syscall.SIGUSR2: false,
+}
@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+var drainSignals = map[os.Signal]bool{}
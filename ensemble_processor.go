@@ -0,0 +1,246 @@
+package deepbooru
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrPartial = errors.New("partial result")
+var ErrInvalidStrategy = errors.New("invalid merge strategy")
+
+type PartialError struct {
+	Failed map[string]error
+}
+
+func (e *PartialError) Names() []string {
+	names := make([]string, 0, len(e.Failed))
+
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (e *PartialError) Error() string {
+	names := e.Names()
+
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%s: %s", name, e.Failed[name])
+	}
+
+	return ErrPartial.Error() + ", failed " + strings.Join(names, ", ")
+}
+
+func (e *PartialError) Unwrap() error {
+	return ErrPartial
+}
+
+type MergeStrategy int
+
+const (
+	MergeAverage MergeStrategy = iota
+	MergeMax
+	MergeUnion
+)
+
+func ParseMergeStrategy(s string) (MergeStrategy, error) {
+	switch s {
+	case "average", "":
+		return MergeAverage, nil
+	case "max":
+		return MergeMax, nil
+	case "union":
+		return MergeUnion, nil
+	}
+
+	return MergeAverage, fmt.Errorf("%w: %q", ErrInvalidStrategy, s)
+}
+
+func (s MergeStrategy) String() string {
+	switch s {
+	case MergeMax:
+		return "max"
+	case MergeUnion:
+		return "union"
+	default:
+		return "average"
+	}
+}
+
+type EnsembleMember struct {
+	Processor
+
+	Name      string
+	Weight    float32
+	Threshold float32
+}
+
+type EnsembleProcessor struct {
+	Members  []EnsembleMember
+	Strategy MergeStrategy
+}
+
+type memberResult struct {
+	tags []Tag
+	err  error
+}
+
+func (ep *EnsembleProcessor) Process(global, local context.Context, timeout time.Duration, url string) ([]Tag, error) {
+	results := make([]memberResult, len(ep.Members))
+	var wg sync.WaitGroup
+
+	for i := range ep.Members {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			tags, err := ep.Members[i].Process(global, local, timeout, url)
+			results[i] = memberResult{tags, err}
+		}(i)
+	}
+
+	wg.Wait()
+
+	failed := make(map[string]error)
+	var firstErr error
+
+	for i, r := range results {
+		if r.err == nil {
+			continue
+		}
+
+		if firstErr == nil {
+			firstErr = r.err
+		}
+
+		failed[ep.name(i)] = r.err
+	}
+
+	if len(failed) == len(ep.Members) {
+		if firstErr == nil {
+			return nil, ErrInvalid
+		}
+
+		return nil, firstErr
+	}
+
+	if global.Err() != nil {
+		return nil, ErrTerminated
+	}
+
+	if local.Err() != nil {
+		return nil, ErrCancelled
+	}
+
+	tags := ep.merge(results)
+
+	if len(failed) > 0 {
+		return tags, &PartialError{Failed: failed}
+	}
+
+	return tags, nil
+}
+
+func (ep *EnsembleProcessor) name(i int) string {
+	if ep.Members[i].Name != "" {
+		return ep.Members[i].Name
+	}
+
+	return fmt.Sprintf("member %d", i)
+}
+
+func (ep *EnsembleProcessor) merge(results []memberResult) []Tag {
+	scores := make(map[string]float32)
+	var totalWeight float32
+
+	for i, r := range results {
+		if r.err != nil {
+			continue
+		}
+
+		m := ep.Members[i]
+		weight := m.Weight
+
+		if weight <= 0 {
+			weight = 1
+		}
+
+		totalWeight += weight
+
+		for _, tag := range r.tags {
+			switch ep.Strategy {
+			case MergeAverage:
+				scores[tag.Name] += weight * tag.Score
+			case MergeUnion:
+				if tag.Score < m.Threshold {
+					continue
+				}
+
+				fallthrough
+			default:
+				if score, ok := scores[tag.Name]; !ok || tag.Score > score {
+					scores[tag.Name] = tag.Score
+				}
+			}
+		}
+	}
+
+	tags := make([]Tag, 0, len(scores))
+
+	for name, score := range scores {
+		if ep.Strategy == MergeAverage {
+			score /= totalWeight
+		}
+
+		tags = append(tags, Tag{Name: name, Score: score})
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Score != tags[j].Score {
+			return tags[i].Score > tags[j].Score
+		}
+
+		return tags[i].Name < tags[j].Name
+	})
+
+	return tags
+}
+
+func (ep *EnsembleProcessor) Capacity() int {
+	capacity := -1
+
+	for _, m := range ep.Members {
+		if c := m.Capacity(); capacity < 0 || c < capacity {
+			capacity = c
+		}
+	}
+
+	if capacity < 0 {
+		return 0
+	}
+
+	return capacity
+}
+
+func (ep *EnsembleProcessor) IsReady() bool {
+	if ep == nil || len(ep.Members) == 0 {
+		return false
+	}
+
+	for _, m := range ep.Members {
+		if !m.IsReady() {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,107 @@
+package deepbooru
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testStaticProcessor struct {
+	tags     []Tag
+	err      error
+	capacity int
+}
+
+func (p *testStaticProcessor) Process(global, local context.Context, timeout time.Duration, url string) ([]Tag, error) {
+	return p.tags, p.err
+}
+
+func (p *testStaticProcessor) Capacity() int {
+	return p.capacity
+}
+
+func (p *testStaticProcessor) IsReady() bool {
+	return true
+}
+
+func TestEnsembleProcessorMerge(t *testing.T) {
+	a := &testStaticProcessor{tags: []Tag{{"cat", 0.5}, {"dog", 0.25}}}
+	b := &testStaticProcessor{tags: []Tag{{"cat", 1}, {"tree", 0.75}}}
+	cases := []struct {
+		strategy MergeStrategy
+		expected []Tag
+	}{
+		{MergeAverage, []Tag{{"cat", 0.875}, {"tree", 0.5625}, {"dog", 0.0625}}},
+		{MergeMax, []Tag{{"cat", 1}, {"tree", 0.75}, {"dog", 0.25}}},
+		{MergeUnion, []Tag{{"cat", 1}, {"dog", 0.25}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.strategy.String(), func(t *testing.T) {
+			ep := &EnsembleProcessor{
+				Members: []EnsembleMember{
+					{Processor: a, Name: "a", Weight: 1, Threshold: 0.2},
+					{Processor: b, Name: "b", Weight: 3, Threshold: 0.9},
+				},
+				Strategy: c.strategy,
+			}
+
+			tags, err := ep.Process(context.Background(), context.Background(), 0, "test")
+
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			if !reflect.DeepEqual(tags, c.expected) {
+				t.Errorf("tags: %v; expected: %v", tags, c.expected)
+			}
+		})
+	}
+}
+
+func TestEnsembleProcessorPartial(t *testing.T) {
+	ep := &EnsembleProcessor{
+		Members: []EnsembleMember{
+			{Processor: &testStaticProcessor{tags: []Tag{{"cat", 0.5}}}, Name: "a"},
+			{Processor: &testStaticProcessor{err: ErrTimeout}, Name: "b"},
+		},
+	}
+
+	tags, err := ep.Process(context.Background(), context.Background(), 0, "test")
+
+	var partial *PartialError
+
+	if !errors.Is(err, ErrPartial) || !errors.As(err, &partial) || partial.Failed["b"] != ErrTimeout {
+		t.Errorf("err: %v; expected a partial result", err)
+	}
+
+	if !reflect.DeepEqual(tags, []Tag{{"cat", 0.5}}) {
+		t.Errorf("tags: %v", tags)
+	}
+
+	ep.Members[0].Processor = &testStaticProcessor{err: ErrInvalid}
+
+	if _, err := ep.Process(context.Background(), context.Background(), 0, "test"); err != ErrInvalid {
+		t.Errorf("err: %v; expected the first error when every member fails", err)
+	}
+}
+
+func TestEnsembleProcessorCapacity(t *testing.T) {
+	ep := &EnsembleProcessor{
+		Members: []EnsembleMember{
+			{Processor: &testStaticProcessor{capacity: 3}},
+			{Processor: &testStaticProcessor{capacity: 1}},
+			{Processor: &testStaticProcessor{capacity: 2}},
+		},
+	}
+
+	if capacity := ep.Capacity(); capacity != 1 {
+		t.Errorf("capacity: %d; expected: 1", capacity)
+	}
+
+	if capacity := (&EnsembleProcessor{}).Capacity(); capacity != 0 {
+		t.Errorf("empty capacity: %d; expected: 0", capacity)
+	}
+}
@@ -3,14 +3,34 @@ package deepbooru
 import (
 	"context"
 	"errors"
+	"strings"
 	"time"
 )
 
 var ErrAlreadyRunning = errors.New("already running")
 var ErrCancelled = errors.New("cancelled")
 var ErrInvalid = errors.New("invalid")
+var ErrNotFound = errors.New("not found")
+var ErrStale = errors.New("stale attempt")
 var ErrTerminated = errors.New("terminated")
 var ErrTimeout = errors.New("timeout")
+var ErrUnavailable = errors.New("unavailable")
+
+type TerminatedError struct {
+	Output []string
+}
+
+func (e *TerminatedError) Error() string {
+	if len(e.Output) == 0 {
+		return ErrTerminated.Error()
+	}
+
+	return ErrTerminated.Error() + ", last output:\n" + strings.Join(e.Output, "\n")
+}
+
+func (e *TerminatedError) Unwrap() error {
+	return ErrTerminated
+}
 
 type Status int8
 type ErrorCode int8
@@ -39,39 +59,69 @@ type Info struct {
 	URL      string
 	Status   Status
 	Tags     []Tag
+	Failed   []string
 	Priority int
+	Requires []string
+	Attempt  int64
 
+	Submitter string
+	Level     AccessLevel
+
+	Submitted    time.Time
 	LastActivity time.Time
 	ErrorReason  string
 	ErrorCode    ErrorCode
 }
 
+func (i *Info) Partial() bool {
+	return i.Status == Done && len(i.Failed) > 0
+}
+
+type Lease struct {
+	ID      int64
+	Attempt int64
+}
+
+type WorkerInfo struct {
+	Node         string
+	Capacity     int
+	Model        string
+	ModelVersion string
+	Capabilities []string
+	Draining     bool
+	Queued       []int64
+}
+
 type Storage interface {
 	AbortStalled(timeout time.Duration) ([]Info, error)
 	ListActive() ([]Info, error)
 	QueueSize() (int, error)
 	Position(id int64) (int, error)
 
-	Push(url string, priority int) (*Info, error)
-	Pop(n int) ([]Info, error)
-	Reset(ids []int64) error
+	Push(url string, priority int, requires []string, submitter Auth) (*Info, error)
+	Pop(n int, capabilities []string) ([]Info, error)
+	Reset(leases []Lease) error
 	Get(id int64) (*Info, error)
+	Cancel(id int64) error
 
-	Beat(id int64) error
-	Done(id int64, tags []Tag) error
-	Error(id int64, code ErrorCode, reason string) error
+	Beat(id, attempt int64) error
+	Done(id, attempt int64, tags []Tag, failed []string) error
+	Error(id, attempt int64, code ErrorCode, reason string) error
 }
 
 type Bus interface {
-	Beat(id int64) error
+	Beat(id, attempt int64) error
 	Cancel(id int64) error
-	Done(id int64, tags []Tag) error
-	Error(id int64, code ErrorCode, reason string) error
+	Done(id, attempt int64, tags []Tag, failed []string) error
+	Error(id, attempt int64, code ErrorCode, reason string) error
 
-	Deschedule(ids []int64) error
+	Deschedule(leases []Lease) error
 	Schedule(node string, tasks []Info) error
 	WakeUp() error
-	WorkerStatus(node string, capacity int) error
+	WorkerStatus(status WorkerInfo) error
+	Reload(node string) error
+	Drain(node string, enable bool) error
+	Reclaim(node string, ids []int64) error
 }
 
 type Terminator func()
@@ -88,6 +138,11 @@ type Processor interface {
 	IsReady() bool
 }
 
+type Reloader interface {
+	Reload(ctx context.Context) error
+	Model() (name, version string)
+}
+
 type Ticker interface {
 	OnTick(t time.Time) error
 }
@@ -95,7 +150,7 @@ type Ticker interface {
 type Client interface {
 	Cancel(id int64) error
 	Get(id int64) (*Info, error)
-	Identify(url string, priority int) (int64, error)
+	Identify(url string, priority int, requires []string) (int64, error)
 
 	OnBeat(id int64) error
 	OnCancel(id int64) error
@@ -0,0 +1,137 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"deepbooru"
+)
+
+type Handler struct {
+	Manager *deepbooru.Manager
+	Level   deepbooru.AccessLevel
+
+	mux *http.ServeMux
+}
+
+func New(m *deepbooru.Manager) *Handler {
+	h := &Handler{Manager: m, Level: deepbooru.LevelAdmin, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/workers", h.workers)
+	h.mux.HandleFunc("/workers/", h.worker)
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r) {
+		return
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func fail(w http.ResponseWriter, status int, reason string) {
+	reply(w, status, map[string]string{"error": reason})
+}
+
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request) bool {
+	authorizer := h.Manager.Authorizer
+
+	if authorizer == nil {
+		authorizer = deepbooru.NoopAuthorizer()
+	}
+
+	auth, err := authorizer.Authorize(r.Header.Get("Authorization"))
+
+	if err != nil {
+		fail(w, http.StatusUnauthorized, "unauthorized")
+
+		return false
+	}
+
+	if auth.Level < h.Level {
+		fail(w, http.StatusForbidden, "forbidden")
+
+		return false
+	}
+
+	return true
+}
+
+func (h *Handler) workers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		fail(w, http.StatusMethodNotAllowed, "method not allowed")
+
+		return
+	}
+
+	reply(w, http.StatusOK, h.Manager.Registry.Nodes())
+}
+
+func (h *Handler) worker(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/workers/")
+
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		h.action(w, r, name[:i], name[i+1:])
+
+		return
+	}
+
+	if r.Method != "GET" {
+		fail(w, http.StatusMethodNotAllowed, "method not allowed")
+
+		return
+	}
+
+	node, ok := h.Manager.Registry.Node(name)
+
+	if !ok {
+		fail(w, http.StatusNotFound, "not found")
+
+		return
+	}
+
+	reply(w, http.StatusOK, node)
+}
+
+func (h *Handler) action(w http.ResponseWriter, r *http.Request, name, action string) {
+	if r.Method != "POST" {
+		fail(w, http.StatusMethodNotAllowed, "method not allowed")
+
+		return
+	}
+
+	var err error
+
+	switch action {
+	case "drain":
+		err = h.Manager.Drain(name, true)
+	case "resume":
+		err = h.Manager.Drain(name, false)
+	default:
+		fail(w, http.StatusNotFound, "not found")
+
+		return
+	}
+
+	if err == deepbooru.ErrNotFound {
+		fail(w, http.StatusNotFound, "not found")
+
+		return
+	}
+
+	if err != nil {
+		fail(w, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	reply(w, http.StatusAccepted, map[string]string{"node": name, "action": action})
+}
@@ -0,0 +1,174 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"deepbooru"
+)
+
+func get(t *testing.T, h http.Handler, path string, v interface{}) int {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("Authorization", "admin")
+	h.ServeHTTP(w, r)
+
+	if v != nil && w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+	}
+
+	return w.Code
+}
+
+func TestWorkers(t *testing.T) {
+	m := deepbooru.NewManager(testAuthorizer, nil, nil)
+	m.Registry.Seen(deepbooru.WorkerInfo{Node: "a", Capacity: 2, Model: "wd14"})
+	m.Registry.Seen(deepbooru.WorkerInfo{Node: "b", Capacity: 1})
+	m.Registry.Assign("a", []deepbooru.Lease{{ID: 3, Attempt: 1}, {ID: 1, Attempt: 1}})
+
+	h := New(m)
+	var nodes []deepbooru.NodeInfo
+
+	if code := get(t, h, "/workers", &nodes); code != http.StatusOK {
+		t.Fatalf("code: %d", code)
+	}
+
+	if len(nodes) != 2 || nodes[0].Node != "a" || nodes[0].Model != "wd14" || len(nodes[0].Jobs) != 2 {
+		t.Errorf("nodes: %+v", nodes)
+	}
+
+	var node deepbooru.NodeInfo
+
+	if code := get(t, h, "/workers/b", &node); code != http.StatusOK || node.Capacity != 1 {
+		t.Errorf("code: %d, node: %+v", code, node)
+	}
+
+	if code := get(t, h, "/workers/c", nil); code != http.StatusNotFound {
+		t.Errorf("code: %d; expected: 404", code)
+	}
+}
+
+type testBus struct {
+	deepbooru.ManagerBus
+
+	drained map[string]bool
+}
+
+func (b *testBus) Drain(node string, enable bool) error {
+	b.drained[node] = enable
+
+	return nil
+}
+
+type testBusFactory struct {
+	bus *testBus
+}
+
+func (f *testBusFactory) Publish() deepbooru.Bus {
+	return f.bus
+}
+
+func (f *testBusFactory) SubscribeAll(bus deepbooru.Bus, consume bool, types ...string) (deepbooru.Terminator, error) {
+	return func() {}, nil
+}
+
+func (f *testBusFactory) SubscribeOne(bus deepbooru.Bus, consume bool, id int64, types ...string) (deepbooru.Terminator, error) {
+	return func() {}, nil
+}
+
+func post(h http.Handler, path string) int {
+	return postAs(h, path, "admin")
+}
+
+func postAs(h http.Handler, path, credentials string) int {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", path, nil)
+	r.Header.Set("Authorization", credentials)
+	h.ServeHTTP(w, r)
+
+	return w.Code
+}
+
+var testAuthorizer = deepbooru.AuthorizerFunc(func(credentials string) (deepbooru.Auth, error) {
+	switch credentials {
+	case "admin":
+		return deepbooru.Auth{ID: "1", Name: "admin", Level: deepbooru.LevelAdmin}, nil
+	case "user":
+		return deepbooru.Auth{ID: "2", Name: "user", Level: deepbooru.LevelUser}, nil
+	case "":
+		return deepbooru.Anonymous, nil
+	}
+
+	return deepbooru.Anonymous, errors.New("invalid credentials")
+})
+
+func TestDrain(t *testing.T) {
+	bus := &testBus{drained: make(map[string]bool)}
+	m := deepbooru.NewManager(testAuthorizer, &testBusFactory{bus}, nil)
+	m.Registry.Seen(deepbooru.WorkerInfo{Node: "a"})
+	h := New(m)
+
+	if code := post(h, "/workers/a/drain"); code != http.StatusAccepted || !bus.drained["a"] {
+		t.Errorf("code: %d, drained: %v", code, bus.drained)
+	}
+
+	if code := post(h, "/workers/a/resume"); code != http.StatusAccepted || bus.drained["a"] {
+		t.Errorf("code: %d, drained: %v", code, bus.drained)
+	}
+
+	if code := post(h, "/workers/b/drain"); code != http.StatusNotFound {
+		t.Errorf("code: %d; expected: 404", code)
+	}
+
+	if code := get(t, h, "/workers/a/drain", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("code: %d; expected: 405", code)
+	}
+}
+
+func TestDrainUnauthorized(t *testing.T) {
+	bus := &testBus{drained: make(map[string]bool)}
+	m := deepbooru.NewManager(testAuthorizer, &testBusFactory{bus}, nil)
+	m.Registry.Seen(deepbooru.WorkerInfo{Node: "a"})
+	h := New(m)
+
+	cases := []struct {
+		credentials string
+		code        int
+	}{
+		{"", http.StatusForbidden},
+		{"user", http.StatusForbidden},
+		{"bogus", http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		if code := postAs(h, "/workers/a/drain", c.credentials); code != c.code {
+			t.Errorf("%q: code: %d; expected: %d", c.credentials, code, c.code)
+		}
+	}
+
+	if len(bus.drained) != 0 {
+		t.Errorf("drained: %v; expected no changes", bus.drained)
+	}
+}
+
+func TestWorkersUnauthorized(t *testing.T) {
+	m := deepbooru.NewManager(testAuthorizer, nil, nil)
+	m.Registry.Seen(deepbooru.WorkerInfo{Node: "a"})
+	h := New(m)
+
+	for _, path := range []string{"/workers", "/workers/a"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "user")
+		h.ServeHTTP(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: code: %d; expected: 403", path, w.Code)
+		}
+	}
+}
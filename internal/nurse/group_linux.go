@@ -0,0 +1,44 @@
+package nurse
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+func groupMembers(pgid int) []int {
+	entries, err := ioutil.ReadDir("/proc")
+
+	if err != nil {
+		return nil
+	}
+
+	var members []int
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+
+		if err != nil {
+			continue
+		}
+
+		data, err := ioutil.ReadFile("/proc/" + entry.Name() + "/stat")
+
+		if err != nil {
+			continue
+		}
+
+		stat := string(data)
+		fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+
+		if len(fields) < 3 || fields[0] == "Z" {
+			continue
+		}
+
+		if fields[2] == strconv.Itoa(pgid) {
+			members = append(members, pid)
+		}
+	}
+
+	return members
+}
@@ -7,18 +7,85 @@ import (
 	"time"
 )
 
-func TerminateOrKill(cmd *exec.Cmd, cancel context.CancelFunc, timeout time.Duration) (killed bool, err error) {
-	cmd.Process.Signal(syscall.SIGTERM)
+const groupPollInterval = 50 * time.Millisecond
+
+func TerminateOrKill(cmd *exec.Cmd, cancel context.CancelFunc, timeout time.Duration) (killed []int, err error) {
+	return terminateOrKill(cmd, cancel, timeout, cmd.Wait)
+}
+
+func terminateOrKill(cmd *exec.Cmd, cancel context.CancelFunc, timeout time.Duration, wait func() error) (killed []int, err error) {
+	deadline := time.Now().Add(timeout)
+
+	if grouped(cmd) {
+		signalGroup(cmd.Process.Pid, syscall.SIGTERM)
+	} else if cmd.Process != nil {
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+
+	result := make(chan error, 1)
+	timer := time.NewTimer(timeout)
+
+	defer timer.Stop()
 
 	go func() {
-		time.Sleep(timeout)
-		killed = true
-		cancel()
+		result <- wait()
 	}()
 
-	err = cmd.Wait()
+	select {
+	case err = <-result:
+		killed = terminateGroup(cmd, time.Until(deadline))
+	case <-timer.C:
+		killed = killGroup(cmd)
+		cancel()
+		err = <-result
+	}
 
 	cancel()
 
 	return
 }
+
+func terminateGroup(cmd *exec.Cmd, timeout time.Duration) []int {
+	if !grouped(cmd) {
+		return nil
+	}
+
+	pgid := cmd.Process.Pid
+
+	if len(groupMembers(pgid)) == 0 {
+		return nil
+	}
+
+	signalGroup(pgid, syscall.SIGTERM)
+
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(groupPollInterval)
+
+		if len(groupMembers(pgid)) == 0 {
+			return nil
+		}
+	}
+
+	return killGroup(cmd)
+}
+
+func killGroup(cmd *exec.Cmd) []int {
+	if cmd.Process == nil {
+		return nil
+	}
+
+	if !grouped(cmd) {
+		cmd.Process.Kill()
+
+		return []int{cmd.Process.Pid}
+	}
+
+	members := groupMembers(cmd.Process.Pid)
+
+	signalGroup(cmd.Process.Pid, syscall.SIGKILL)
+	cmd.Process.Kill()
+
+	return members
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"os/exec"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -23,7 +24,7 @@ func TestTerminateOrKillOK(t *testing.T) {
 
 	killed, _ := TerminateOrKill(cmd, cancel, 10*time.Second)
 
-	if killed {
+	if len(killed) > 0 {
 		t.Errorf("Killed")
 	}
 
@@ -66,7 +67,7 @@ func TestTerminateOrKillTimeout(t *testing.T) {
 
 	killed, _ := TerminateOrKill(cmd, cancel, time.Second)
 
-	if !killed {
+	if len(killed) == 0 {
 		t.Errorf("Finished succesfully")
 	}
 
@@ -74,3 +75,44 @@ func TestTerminateOrKillTimeout(t *testing.T) {
 		t.Errorf("Context is not cancelled")
 	}
 }
+
+func TestTerminateOrKillGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	t.Cleanup(cancel)
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", "(trap '' TERM; exec sleep 30) & echo $!; exec sleep 30")
+	Setpgid(cmd)
+	stdout, err := cmd.StdoutPipe()
+
+	if err != nil {
+		t.Fatalf("Failed to create stdout pipe: %s", err)
+	}
+
+	err = cmd.Start()
+
+	if err != nil {
+		t.Fatalf("Failed to start subprocess: %s", err)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+
+	if !scanner.Scan() {
+		t.Fatalf("No grandchild PID")
+	}
+
+	grandchild, _ := strconv.Atoi(scanner.Text())
+
+	// give the grandchild time to set up its trap
+	time.Sleep(100 * time.Millisecond)
+
+	killed, _ := TerminateOrKill(cmd, cancel, 500*time.Millisecond)
+
+	if len(killed) != 1 || killed[0] != grandchild {
+		t.Errorf("killed: %v; expected: [%d]", killed, grandchild)
+	}
+
+	if !waitFor(func() bool { return len(groupMembers(cmd.Process.Pid)) == 0 }, time.Second) {
+		t.Errorf("group members left: %v", groupMembers(cmd.Process.Pid))
+	}
+}
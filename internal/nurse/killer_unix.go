@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package nurse
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func Setpgid(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func grouped(cmd *exec.Cmd) bool {
+	return cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid && cmd.Process != nil
+}
+
+func signalGroup(pgid int, sig syscall.Signal) {
+	syscall.Kill(-pgid, sig)
+}
@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package nurse
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func Setpgid(cmd *exec.Cmd) {}
+
+func grouped(cmd *exec.Cmd) bool {
+	return false
+}
+
+func signalGroup(pgid int, sig syscall.Signal) {}
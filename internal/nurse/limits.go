@@ -0,0 +1,23 @@
+package nurse
+
+import (
+	"errors"
+	"time"
+)
+
+const DefaultWatchdogInterval = 10 * time.Second
+
+var ErrUnsupported = errors.New("not supported on this platform")
+
+type Limits struct {
+	AddressSpace uint64
+	CPUTime      time.Duration
+	OpenFiles    uint64
+
+	Cgroup    string
+	MemoryMax uint64
+}
+
+func (l Limits) rlimits() bool {
+	return l.AddressSpace > 0 || l.CPUTime > 0 || l.OpenFiles > 0
+}
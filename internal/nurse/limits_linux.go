@@ -0,0 +1,100 @@
+package nurse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func (l Limits) apply(cmd *exec.Cmd, name string) (cgroup string, err error) {
+	if !l.rlimits() && l.Cgroup == "" {
+		return "", nil
+	}
+
+	var script strings.Builder
+	procs := ""
+
+	if l.Cgroup != "" {
+		cgroup, err = createCgroup(l.Cgroup, name, l.MemoryMax)
+
+		if err != nil {
+			return "", err
+		}
+
+		procs = filepath.Join(cgroup, "cgroup.procs")
+		script.WriteString(`echo $$ > "$1" || exit 126` + "\n")
+	}
+
+	script.WriteString("shift\n")
+
+	if l.AddressSpace > 0 {
+		fmt.Fprintf(&script, "ulimit -v %d || exit 126\n", (l.AddressSpace+1023)/1024)
+	}
+
+	if l.CPUTime > 0 {
+		seconds := uint64(l.CPUTime.Seconds())
+
+		if seconds == 0 {
+			seconds = 1
+		}
+
+		fmt.Fprintf(&script, "ulimit -t %d || exit 126\n", seconds)
+	}
+
+	if l.OpenFiles > 0 {
+		fmt.Fprintf(&script, "ulimit -n %d || exit 126\n", l.OpenFiles)
+	}
+
+	script.WriteString(`exec "$@"`)
+
+	cmd.Args = append([]string{"sh", "-c", script.String(), "nurse", procs, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+
+	return cgroup, nil
+}
+
+func createCgroup(parent, name string, memoryMax uint64) (string, error) {
+	path, err := ioutil.TempDir(parent, name+"-")
+
+	if err != nil {
+		return "", err
+	}
+
+	if memoryMax > 0 {
+		err = ioutil.WriteFile(filepath.Join(path, "memory.max"), []byte(strconv.FormatUint(memoryMax, 10)), 0644)
+
+		if err != nil {
+			os.Remove(path)
+
+			return "", err
+		}
+	}
+
+	return path, nil
+}
+
+func rss(pid int) (uint64, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected statm: %q", data)
+	}
+
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return pages * uint64(os.Getpagesize()), nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package nurse
+
+import "os/exec"
+
+func (l Limits) apply(cmd *exec.Cmd, name string) (cgroup string, err error) {
+	if !l.rlimits() && l.Cgroup == "" {
+		return "", nil
+	}
+
+	return "", ErrUnsupported
+}
+
+func rss(pid int) (uint64, error) {
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,123 @@
+package nurse
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"deepbooru/ipc"
+)
+
+const testHello = `echo '{"hello":{"version":1}}'`
+
+func TestNurseRecycle(t *testing.T) {
+	n := &Nurse{
+		Path:        "sh",
+		Args:        []string{"-c", testHello + `; read line; sleep 0.3; echo "$line"; exec cat`},
+		KillTimeout: time.Second,
+	}
+
+	startNurse(t, n)
+
+	if !waitFor(n.IsReady, 5*time.Second) {
+		t.Fatalf("Not ready")
+	}
+
+	pid := n.Status().PID
+	n.In() <- deepbooru_ipc.Message{URL: "http://example.com/1.jpg"}
+
+	if !waitFor(func() bool { return n.Status().InFlight == 1 }, time.Second) {
+		t.Fatalf("status: %+v; expected 1 in-flight request", n.Status())
+	}
+
+	n.Recycle()
+
+	if n.IsReady() {
+		t.Errorf("Ready while recycling")
+	}
+
+	if m := <-n.Out(); m.URL != "http://example.com/1.jpg" {
+		t.Errorf("message: %#v", m)
+	}
+
+	if !waitFor(func() bool { return n.IsReady() && n.Status().PID != pid }, 5*time.Second) {
+		t.Fatalf("status: %+v; expected a new process", n.Status())
+	}
+
+	if status := n.Status(); status.Restarts != 1 || status.FailedRestarts != 0 || status.Recycling {
+		t.Errorf("status: %+v", status)
+	}
+}
+
+func TestNurseWatchdog(t *testing.T) {
+	n := &Nurse{
+		Path:             "sh",
+		Args:             []string{"-c", testHello + `; exec cat`},
+		KillTimeout:      time.Second,
+		SoftMemoryLimit:  1,
+		WatchdogInterval: 20 * time.Millisecond,
+	}
+
+	startNurse(t, n)
+
+	if !waitFor(func() bool { return n.Status().Restarts > 0 }, 5*time.Second) {
+		t.Fatalf("status: %+v; expected the process to be recycled", n.Status())
+	}
+}
+
+func TestNurseRlimits(t *testing.T) {
+	n := &Nurse{
+		Path:        "sh",
+		Args:        []string{"-c", testHello + `; ulimit -n >&2; exec cat`},
+		KillTimeout: time.Second,
+		Limits:      Limits{OpenFiles: 64},
+		Logger:      func(Line) {},
+	}
+
+	startNurse(t, n)
+
+	if !waitFor(func() bool { return len(n.Output()) > 0 }, 5*time.Second) {
+		t.Fatalf("no output")
+	}
+
+	if output := n.Output(); !strings.HasSuffix(output[0], " 64") {
+		t.Errorf("output: %q; expected open files limit of 64", output)
+	}
+}
+
+func TestNurseCgroup(t *testing.T) {
+	parent := t.TempDir()
+	n := &Nurse{
+		Name:        "model",
+		Path:        "sh",
+		Args:        []string{"-c", testHello + `; exec cat`},
+		KillTimeout: time.Second,
+		Limits:      Limits{Cgroup: parent, MemoryMax: 1 << 30},
+	}
+
+	startNurse(t, n)
+
+	if !waitFor(n.IsReady, 5*time.Second) {
+		t.Fatalf("Not ready")
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(parent, "model-*"))
+
+	if len(paths) != 1 {
+		t.Fatalf("cgroups: %v; expected one", paths)
+	}
+
+	procs, _ := ioutil.ReadFile(filepath.Join(paths[0], "cgroup.procs"))
+	memoryMax, _ := ioutil.ReadFile(filepath.Join(paths[0], "memory.max"))
+
+	if pid := strings.TrimSpace(string(procs)); pid != strconv.Itoa(n.Status().PID) {
+		t.Errorf("cgroup.procs: %q; expected the pid of the process %d", procs, n.Status().PID)
+	}
+
+	if string(memoryMax) != "1073741824" {
+		t.Errorf("memory.max: %q", memoryMax)
+	}
+}
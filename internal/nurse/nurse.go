@@ -2,10 +2,12 @@ package nurse
 
 import (
 	"context"
-	"errors"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"deepbooru"
@@ -14,18 +16,39 @@ import (
 
 const MinAliveTime = 5 * time.Second
 const MaxFailedRestarts = 5
+const DefaultStartupTimeout = 60 * time.Second
 
 type Nurse struct {
+	sync.Mutex
+
+	Name    string
 	Path    string
 	Args    []string
 	Environ []string
 
-	KillTimeout time.Duration
+	KillTimeout    time.Duration
+	StartupTimeout time.Duration
+	InterruptGrace time.Duration
+
+	Limits           Limits
+	SoftMemoryLimit  uint64
+	WatchdogInterval time.Duration
+
+	Restart           RestartPolicy
+	MinBackoff        time.Duration
+	MaxBackoff        time.Duration
+	MinAliveTime      time.Duration
+	MaxFailedRestarts int
+
+	OutputLines int
+	Logger      func(Line)
 
-	in  chan deepbooru_ipc.Message
-	out chan deepbooru_ipc.Message
+	in   chan deepbooru_ipc.Message
+	out  chan deepbooru_ipc.Message
+	done chan struct{}
 
 	interrupt chan bool
+	lost      chan deepbooru_ipc.Message
 
 	nurseStdin    *os.File
 	nurseStdout   *os.File
@@ -33,9 +56,21 @@ type Nurse struct {
 	processStdout *os.File
 
 	cmd *exec.Cmd
+	pid int
 
 	started bool
 	ready   bool
+	hello   *deepbooru_ipc.Hello
+	greeted chan struct{}
+
+	output *Ring
+	stdout classifier
+
+	status Status
+
+	outstanding []*request
+	recycling   bool
+	recycle     chan struct{}
 
 	now func() time.Time
 }
@@ -51,83 +86,255 @@ func (n *Nurse) Run(ctx context.Context) error {
 		return err
 	}
 
-	restart := true
-	failedRestarts := 0
-	var start, end time.Time
+	minAliveTime := n.MinAliveTime
+
+	if minAliveTime <= 0 {
+		minAliveTime = MinAliveTime
+	}
+
+	maxFailedRestarts := n.MaxFailedRestarts
+
+	if maxFailedRestarts <= 0 {
+		maxFailedRestarts = MaxFailedRestarts
+	}
+
+	for {
+		start := n.now()
+		code, stopped, recycled := n.loop(ctx)
+
+		if stopped {
+			n.setState(Stopped)
+
+			break
+		}
+
+		if recycled {
+			n.Lock()
+			n.status.Restarts++
+			n.Unlock()
+
+			continue
+		}
+
+		if !n.Restart.restart(code) {
+			log.Printf("Process exited with code %d, not restarting (policy %s)", code, n.Restart)
+			n.setState(Exited)
+
+			break
+		}
 
-	for restart && failedRestarts < MaxFailedRestarts {
-		start = n.now()
-		restart = n.loop(ctx)
-		end = n.now()
+		n.Lock()
 
-		if end.Sub(start) < MinAliveTime {
-			failedRestarts++
+		if n.now().Sub(start) < minAliveTime {
+			n.status.FailedRestarts++
 		} else {
-			failedRestarts = 0
+			n.status.FailedRestarts = 0
+		}
+
+		failures := n.status.FailedRestarts
+
+		if failures >= maxFailedRestarts {
+			n.status.State = CrashLoop
+			n.Unlock()
+
+			log.Printf("Process failed %d times in a row, giving up", failures)
+			err = ErrCrashLoop
+
+			break
 		}
 
-		log.Println("Restarting dead process...")
+		delay := backoff(failures, n.MinBackoff, n.MaxBackoff)
+		n.status.State = Backoff
+		n.status.NextRestart = n.now().Add(delay)
+		n.Unlock()
+
+		log.Printf("Restarting dead process in %s...", delay)
+
+		if !n.sleep(ctx, delay) {
+			n.setState(Stopped)
+
+			break
+		}
+
+		n.Lock()
+		n.status.Restarts++
+		n.status.NextRestart = time.Time{}
+		n.Unlock()
 	}
 
-	n.in <- deepbooru_ipc.Message{Shutdown: true}
+	n.In() <- deepbooru_ipc.Message{Shutdown: true}
 
 	n.clean()
 
-	if failedRestarts == MaxFailedRestarts {
-		return errors.New("Failed to start process")
+	return err
+}
+
+func (n *Nurse) sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
 	}
 
-	return nil
+	timer := time.NewTimer(d)
+
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
 }
 
-func (n *Nurse) loop(globalCtx context.Context) bool {
-	done := make(chan bool)
+func (n *Nurse) loop(globalCtx context.Context) (code int, stopped, recycled bool) {
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	recycle := make(chan struct{}, 1)
 	ctx, cancel := context.WithCancel(context.Background())
 	cmd := exec.CommandContext(ctx, n.Path, n.Args...)
 
 	cmd.Env = n.Environ
 	cmd.Stdin = n.processStdin
 	cmd.Stdout = n.processStdout
-	cmd.Stderr = os.Stderr
 
+	Setpgid(cmd)
+
+	n.Lock()
 	n.cmd = cmd
+	n.status.State = Starting
+	n.recycle = recycle
+	n.recycling = false
+	n.Unlock()
 
-	go n.run(cmd, done)
+	go n.run(cmd, started, done)
 
 	select {
 	case <-globalCtx.Done():
-		killed, _ := TerminateOrKill(cmd, cancel, n.KillTimeout)
+		<-started
 
-		if killed {
-			log.Printf("Process %d killed", cmd.Process.Pid)
-		}
+		killed, _ := terminateOrKill(cmd, cancel, n.KillTimeout, func() error {
+			return <-done
+		})
 
-		return false
-	case started := <-done:
-		if !started {
-			return false
-		}
+		n.forceKilled(killed)
+
+		return 0, true, false
+	case <-recycle:
+		log.Printf("Recycling process %d", cmd.Process.Pid)
+
+		killed, _ := terminateOrKill(cmd, cancel, n.KillTimeout, func() error {
+			return <-done
+		})
+
+		n.forceKilled(killed)
+
+		return 0, false, true
+	case err := <-done:
+		cancel()
+
+		return exitCode(err), false, false
+	}
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if eerr, ok := err.(*exec.ExitError); ok {
+		return eerr.ExitCode()
 	}
 
-	return true
+	return -1
 }
 
-func (n *Nurse) run(cmd *exec.Cmd, done chan<- bool) {
+func (n *Nurse) run(cmd *exec.Cmd, started chan<- struct{}, done chan<- error) {
 	log.Println("exec", cmd.Path, cmd.Args)
 
-	err := cmd.Start()
+	greeted := make(chan struct{})
+	exited := make(chan struct{})
+	stderr, stderrWriter, err := os.Pipe()
 
 	if err != nil {
-		log.Printf("Failed to start process")
-		done <- false
+		log.Printf("Failed to create stderr pipe: %s", err)
+		close(started)
+		n.exited(err)
+		done <- err
 		return
 	}
 
-	log.Println("started")
+	cmd.Stderr = stderrWriter
+	cgroup, err := n.Limits.apply(cmd, n.Name)
+
+	if err != nil {
+		stderrWriter.Close()
+		stderr.Close()
+
+		log.Printf("Failed to apply limits: %s", err)
+		close(started)
+		n.exited(err)
+		done <- err
+		return
+	}
+
+	n.Lock()
 
+	err = cmd.Start()
+	stderrWriter.Close()
+	close(started)
+
+	if err != nil {
+		n.Unlock()
+		stderr.Close()
+
+		if cgroup != "" {
+			os.Remove(cgroup)
+		}
+
+		log.Printf("Failed to start process: %s", err)
+		n.exited(err)
+		done <- err
+		return
+	}
+
+	n.pid = cmd.Process.Pid
+	n.status.PID = n.pid
 	n.ready = true
+	n.greeted = greeted
+	n.Unlock()
+
+	log.Println("started")
+
+	go n.capture(cmd.Process.Pid, stderr)
+
+	go n.awaitHello(cmd, greeted, exited)
+
+	if n.SoftMemoryLimit > 0 {
+		go n.watch(cmd.Process.Pid, exited)
+	}
+
 	err = cmd.Wait()
+
+	close(exited)
+
+	n.reap(cmd)
+
+	if cgroup != "" {
+		os.Remove(cgroup)
+	}
+
+	n.Lock()
 	n.ready = false
+	n.hello = nil
+	n.greeted = nil
+	lost := n.outstanding
+	n.outstanding = nil
+	n.recycle = nil
+	n.Unlock()
+
+	n.abandon(lost)
+
+	n.exited(err)
 
 	if err == nil {
 		log.Printf("Process %d finished without errors", cmd.Process.Pid)
@@ -137,7 +344,80 @@ func (n *Nurse) run(cmd *exec.Cmd, done chan<- bool) {
 		log.Printf("Process %d finished with error: %s", cmd.Process.Pid, err)
 	}
 
-	done <- true
+	done <- err
+}
+
+func (n *Nurse) exited(err error) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.status.PID = 0
+	n.status.LastExitCode = exitCode(err)
+	n.status.LastExit = n.now()
+	n.status.LastError = ""
+
+	if err != nil {
+		n.status.LastError = err.Error()
+	}
+}
+
+func (n *Nurse) reap(cmd *exec.Cmd) {
+	timeout := n.KillTimeout
+
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	n.forceKilled(terminateGroup(cmd, timeout))
+}
+
+func (n *Nurse) forceKilled(pids []int) {
+	if len(pids) == 0 {
+		return
+	}
+
+	log.Printf("Force-killed processes %v", pids)
+
+	n.Lock()
+	n.status.ForceKilled = pids
+	n.Unlock()
+}
+
+func (n *Nurse) setState(state State) {
+	n.Lock()
+	n.status.State = state
+	n.status.NextRestart = time.Time{}
+	n.Unlock()
+}
+
+func (n *Nurse) Status() Status {
+	n.Lock()
+	defer n.Unlock()
+
+	status := n.status
+	status.InFlight = len(n.outstanding)
+	status.Recycling = n.recycling
+
+	return status
+}
+
+func (n *Nurse) Memory() uint64 {
+	n.Lock()
+	pid := n.pid
+	running := n.ready
+	n.Unlock()
+
+	if !running {
+		return 0
+	}
+
+	size, err := rss(pid)
+
+	if err != nil {
+		return 0
+	}
+
+	return size
 }
 
 func (n *Nurse) init() error {
@@ -163,67 +443,353 @@ func (n *Nurse) init() error {
 		n.now = time.Now
 	}
 
+	if n.Name == "" {
+		n.Name = filepath.Base(n.Path)
+	}
+
+	if n.Logger == nil {
+		n.Logger = LogLine
+	}
+
+	lines := n.OutputLines
+
+	if lines == 0 {
+		lines = DefaultOutputLines
+	}
+
+	n.Lock()
+	n.output = NewRing(lines)
+	n.Unlock()
+
+	raw := make(chan deepbooru_ipc.Message)
+
+	n.Lock()
 	n.in = make(chan deepbooru_ipc.Message)
 	n.out = make(chan deepbooru_ipc.Message)
 	n.interrupt = make(chan bool)
+	n.done = make(chan struct{})
 	n.started = true
+	n.status = Status{}
+	in, interrupt, done, out := n.in, n.interrupt, n.done, n.out
+	n.Unlock()
 
-	go deepbooru_ipc.TranslateWriter(n.nurseStdin, n.in)
-	go deepbooru_ipc.TranslateReader(n.nurseStdout, n.out)
-	go n.handleInterrupts()
+	pipe := make(chan deepbooru_ipc.Message)
+
+	go n.track(in, interrupt, done, pipe)
+	go deepbooru_ipc.TranslateWriter(n.nurseStdin, pipe)
+	go func() {
+		deepbooru_ipc.TranslateNoisyReader(n.nurseStdout, raw, n.stdoutNoise)
+		close(raw)
+	}()
+	n.lost = make(chan deepbooru_ipc.Message)
+
+	go n.dispatch(raw, n.lost, out)
 
 	return nil
 }
 
 func (n *Nurse) clean() {
-	close(n.interrupt)
-	close(n.in)
+	n.Lock()
+	close(n.done)
+	n.in, n.out = nil, nil
+	n.interrupt = nil
+	n.cmd = nil
+	n.started = false
+	n.Unlock()
+
 	n.nurseStdout.Close()
 	n.nurseStdin.Close()
-	close(n.out)
 	n.processStdin.Close()
 	n.processStdout.Close()
 
-	n.in, n.out = nil, nil
-	n.interrupt = nil
 	n.processStdin, n.nurseStdin = nil, nil
 	n.nurseStdout, n.processStdout = nil, nil
-	n.cmd = nil
-	n.started = false
 }
 
-func (n *Nurse) handleInterrupts() {
-	for _ = range n.interrupt {
-		if n.cmd == nil || n.cmd.Process == nil {
-			log.Printf("No process to send interrupt to")
+func (n *Nurse) capture(pid int, stderr io.ReadCloser) {
+	var c classifier
+	w := &lineWriter{emit: func(text string) {
+		n.record(pid, "stderr", c.classify(text), text)
+	}}
 
-			continue
+	io.Copy(w, stderr)
+	w.Flush()
+	stderr.Close()
+}
+
+func (n *Nurse) stdoutNoise(line []byte, _ error) {
+	text := string(line)
+
+	if text == "" {
+		return
+	}
+
+	n.Lock()
+	pid := n.pid
+	n.Unlock()
+
+	n.record(pid, "stdout", n.stdout.classify(text), text)
+}
+
+func (n *Nurse) record(pid int, stream string, level Level, text string) {
+	l := Line{
+		Time:   n.now(),
+		Nurse:  n.Name,
+		PID:    pid,
+		Stream: stream,
+		Level:  level,
+		Text:   text,
+	}
+
+	n.output.Add(l)
+	n.Logger(l)
+}
+
+func (n *Nurse) Output() []string {
+	if n == nil {
+		return nil
+	}
+
+	n.Lock()
+	output, pid := n.output, n.pid
+	n.Unlock()
+
+	if output == nil {
+		return nil
+	}
+
+	var text []string
+
+	for _, l := range output.Lines() {
+		if l.PID == pid {
+			text = append(text, l.String())
 		}
+	}
+
+	return text
+}
 
-		err := n.cmd.Process.Signal(os.Interrupt)
+func (n *Nurse) dispatch(raw, lost <-chan deepbooru_ipc.Message, out chan<- deepbooru_ipc.Message) {
+	defer close(out)
 
-		if err != nil {
-			log.Printf("Failed to send interrupt signal: %s", err)
+	for {
+		select {
+		case m, ok := <-raw:
+			if !ok {
+				return
+			}
+
+			if m.Hello != nil {
+				n.greet(m.Hello)
+
+				continue
+			}
+
+			if n.settle(&m) {
+				out <- m
+			}
+		case m := <-lost:
+			out <- m
 		}
 	}
 }
 
+func (n *Nurse) awaitHello(cmd *exec.Cmd, greeted, exited <-chan struct{}) {
+	timeout := n.StartupTimeout
+
+	if timeout <= 0 {
+		timeout = DefaultStartupTimeout
+	}
+
+	timer := time.NewTimer(timeout)
+
+	defer timer.Stop()
+
+	select {
+	case <-greeted:
+	case <-exited:
+	case <-timer.C:
+		log.Printf("Process %d did not say hello within %s, killing", cmd.Process.Pid, timeout)
+		killGroup(cmd)
+	}
+}
+
+func (n *Nurse) greet(hello *deepbooru_ipc.Hello) {
+	n.Lock()
+	defer n.Unlock()
+
+	if !n.ready || n.cmd == nil {
+		log.Printf("Ignoring hello from dead process")
+
+		return
+	}
+
+	err := hello.Validate()
+
+	if err != nil {
+		log.Printf("Process %d sent invalid hello, killing: %s", n.cmd.Process.Pid, err)
+		killGroup(n.cmd)
+
+		return
+	}
+
+	log.Printf(
+		"Process %d ready: protocol v%d, model %s %s, modes %v, max batch %d",
+		n.cmd.Process.Pid,
+		hello.Version,
+		hello.Model,
+		hello.ModelVersion,
+		hello.Modes,
+		hello.MaxBatch,
+	)
+
+	n.hello = hello
+	n.status.State = Ready
+
+	if n.greeted != nil {
+		close(n.greeted)
+		n.greeted = nil
+	}
+}
+
+func (n *Nurse) Hello() *deepbooru_ipc.Hello {
+	if n == nil {
+		return nil
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	return n.hello
+}
+
+func (n *Nurse) signalInterrupt() {
+	n.Lock()
+	cmd, ready := n.cmd, n.ready
+	n.Unlock()
+
+	if cmd == nil || !ready {
+		log.Printf("No process to send interrupt to")
+
+		return
+	}
+
+	n.interrupted(cmd, 0)
+
+	err := cmd.Process.Signal(os.Interrupt)
+
+	if err != nil {
+		log.Printf("Failed to send interrupt signal: %s", err)
+	}
+}
+
 func (n *Nurse) Interrupt() {
 	if n == nil {
 		return
 	}
 
-	n.interrupt <- true
+	n.Lock()
+	interrupt, done := n.interrupt, n.done
+	n.Unlock()
+
+	select {
+	case interrupt <- true:
+	case <-done:
+	}
 }
 
 func (n *Nurse) IsReady() bool {
-	return n != nil && n.started && n.ready
+	if n == nil {
+		return false
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	return n.started && n.ready && n.hello != nil && !n.recycling
 }
 
 func (n *Nurse) In() chan<- deepbooru_ipc.Message {
+	n.Lock()
+	defer n.Unlock()
+
 	return n.in
 }
 
 func (n *Nurse) Out() <-chan deepbooru_ipc.Message {
+	n.Lock()
+	defer n.Unlock()
+
 	return n.out
 }
+
+func (n *Nurse) Done() <-chan struct{} {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.done
+}
+
+func (n *Nurse) Recycle() {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.recycle == nil || n.recycling {
+		return
+	}
+
+	log.Printf("Process %d will be recycled after %d in-flight requests", n.pid, len(n.outstanding))
+
+	n.recycling = true
+	n.maybeRecycle()
+}
+
+func (n *Nurse) maybeRecycle() {
+	if !n.recycling || len(n.outstanding) > 0 || n.recycle == nil {
+		return
+	}
+
+	select {
+	case n.recycle <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Nurse) watch(pid int, exited <-chan struct{}) {
+	interval := n.WatchdogInterval
+
+	if interval <= 0 {
+		interval = DefaultWatchdogInterval
+	}
+
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+
+		size, err := rss(pid)
+
+		if err != nil {
+			log.Printf("Failed to read memory usage of process %d: %s", pid, err)
+
+			continue
+		}
+
+		n.Lock()
+		n.status.RSS = size
+		n.Unlock()
+
+		if size > n.SoftMemoryLimit {
+			log.Printf("Process %d uses %d bytes, over the soft limit of %d", pid, size, n.SoftMemoryLimit)
+			n.Recycle()
+
+			return
+		}
+	}
+}
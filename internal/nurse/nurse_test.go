@@ -0,0 +1,251 @@
+package nurse
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"deepbooru/ipc"
+)
+
+func waitFor(cond func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return cond()
+}
+
+func (n *Nurse) isStarted() bool {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.started
+}
+
+func startNurse(t *testing.T, n *Nurse) <-chan error {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- n.Run(ctx)
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return done
+}
+
+func TestNurseHandshake(t *testing.T) {
+	n := &Nurse{
+		Path:           "sh",
+		Args:           []string{"-c", `sleep 0.2; echo '{"hello":{"version":1,"model":"test","modes":["url","binary"]}}'; exec cat`},
+		KillTimeout:    time.Second,
+		StartupTimeout: 5 * time.Second,
+	}
+
+	startNurse(t, n)
+
+	if !waitFor(n.isStarted, time.Second) {
+		t.Fatalf("Nurse did not start")
+	}
+
+	if n.IsReady() {
+		t.Errorf("Ready before hello")
+	}
+
+	if !waitFor(n.IsReady, 5*time.Second) {
+		t.Fatalf("Not ready after hello")
+	}
+
+	hello := n.Hello()
+
+	if hello.Model != "test" || !hello.Supports("binary") {
+		t.Errorf("hello: %#v", hello)
+	}
+}
+
+func TestNurseHandshakeFailure(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+	}{
+		{"timeout", "exec cat"},
+		{"invalid", `echo '{"hello":{"version":99}}'; exec cat`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := &Nurse{
+				Path:           "sh",
+				Args:           []string{"-c", c.script},
+				KillTimeout:    time.Second,
+				StartupTimeout: 100 * time.Millisecond,
+				MinBackoff:     10 * time.Millisecond,
+			}
+			done := startNurse(t, n)
+
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Errorf("Run succeeded")
+				}
+			case <-time.After(10 * time.Second):
+				t.Errorf("Process was not restarted")
+			}
+
+			if n.IsReady() {
+				t.Errorf("Ready without a valid hello")
+			}
+		})
+	}
+}
+
+func TestNurseRestartPolicy(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   RestartPolicy
+		script   string
+		state    State
+		err      error
+		restarts int
+		code     int
+	}{
+		{"never", RestartNever, "exit 3", Exited, nil, 0, 3},
+		{"on-failure success", RestartOnFailure, "exit 0", Exited, nil, 0, 0},
+		{"on-failure crash loop", RestartOnFailure, "exit 2", CrashLoop, ErrCrashLoop, 2, 2},
+		{"always crash loop", RestartAlways, "exit 0", CrashLoop, ErrCrashLoop, 2, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := &Nurse{
+				Path:              "sh",
+				Args:              []string{"-c", c.script},
+				KillTimeout:       time.Second,
+				Restart:           c.policy,
+				MinBackoff:        10 * time.Millisecond,
+				MaxBackoff:        20 * time.Millisecond,
+				MaxFailedRestarts: 3,
+			}
+			done := startNurse(t, n)
+
+			select {
+			case err := <-done:
+				if err != c.err {
+					t.Errorf("err: %v; expected: %v", err, c.err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("Run did not return")
+			}
+
+			status := n.Status()
+
+			if status.State != c.state || status.Restarts != c.restarts || status.LastExitCode != c.code {
+				t.Errorf("status: %+v", status)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	if d := backoff(0, time.Second, time.Minute); d != 0 {
+		t.Errorf("backoff(0): %s; expected: 0", d)
+	}
+
+	for failures, max := range []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if failures == 0 {
+			continue
+		}
+
+		d := backoff(failures, time.Second, 5*time.Second)
+
+		if d < max/2 || d > max {
+			t.Errorf("backoff(%d): %s; expected between %s and %s", failures, d, max/2, max)
+		}
+	}
+}
+
+func TestParseRestartPolicy(t *testing.T) {
+	for _, policy := range []RestartPolicy{RestartAlways, RestartOnFailure, RestartNever} {
+		if p, err := ParseRestartPolicy(policy.String()); err != nil || p != policy {
+			t.Errorf("%s: %s, %v", policy, p, err)
+		}
+	}
+
+	if _, err := ParseRestartPolicy("sometimes"); err == nil {
+		t.Errorf("sometimes: expected an error")
+	}
+}
+
+func TestNurseReapsOrphans(t *testing.T) {
+	n := &Nurse{
+		Path:        "sh",
+		Args:        []string{"-c", `(trap '' TERM; exec sleep 30) & sleep 0.1; exit 1`},
+		KillTimeout: 200 * time.Millisecond,
+		Restart:     RestartNever,
+	}
+	done := startNurse(t, n)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return")
+	}
+
+	if status := n.Status(); len(status.ForceKilled) != 1 {
+		t.Errorf("status: %+v; expected one force-killed orphan", status)
+	}
+}
+
+func TestNurseStoppedBus(t *testing.T) {
+	n := &Nurse{
+		Path:        "sh",
+		Args:        []string{"-c", `echo '{"hello":{"version":2}}'; exec cat`},
+		KillTimeout: time.Second,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+
+	go func() {
+		stopped <- n.Run(ctx)
+	}()
+
+	if !waitFor(n.IsReady, 5*time.Second) {
+		t.Fatalf("Not ready")
+	}
+
+	in, done := n.In(), n.Done()
+	cancel()
+	<-stopped
+
+	finished := make(chan struct{})
+
+	go func() {
+		n.Interrupt()
+
+		select {
+		case in <- deepbooru_ipc.Message{ID: 1, Cancel: true}:
+			t.Errorf("message accepted by a stopped nurse")
+		case <-done:
+		}
+
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("sending to a stopped nurse hung")
+	}
+}
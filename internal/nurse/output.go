@@ -0,0 +1,168 @@
+package nurse
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultOutputLines = 100
+const MaxLineLength = 4096
+
+type Level int
+
+const (
+	LevelInfo Level = iota
+	LevelWarning
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelWarning:
+		return "warning"
+	case LevelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+type Line struct {
+	Time   time.Time
+	Nurse  string
+	PID    int
+	Stream string
+	Level  Level
+	Text   string
+}
+
+func (l Line) String() string {
+	return fmt.Sprintf("[%d %s] %s", l.PID, l.Stream, l.Text)
+}
+
+func LogLine(l Line) {
+	log.Printf("level=%s nurse=%s pid=%d stream=%s msg=%q", l.Level, l.Nurse, l.PID, l.Stream, l.Text)
+}
+
+var errorPattern = regexp.MustCompile(`(?i)\b(error|fatal|critical|exception|panic)\b`)
+var warningPattern = regexp.MustCompile(`(?i)\bwarn(ing)?\b`)
+
+type classifier struct {
+	traceback bool
+}
+
+func (c *classifier) classify(text string) Level {
+	if strings.HasPrefix(text, "Traceback (most recent call last):") {
+		c.traceback = true
+
+		return LevelError
+	}
+
+	if c.traceback {
+		if text == "" || text[0] == ' ' || text[0] == '\t' {
+			return LevelError
+		}
+
+		c.traceback = false
+
+		return LevelError
+	}
+
+	if errorPattern.MatchString(text) {
+		return LevelError
+	}
+
+	if warningPattern.MatchString(text) {
+		return LevelWarning
+	}
+
+	return LevelInfo
+}
+
+type Ring struct {
+	sync.Mutex
+
+	size  int
+	lines []Line
+	next  int
+}
+
+func NewRing(size int) *Ring {
+	return &Ring{size: size}
+}
+
+func (r *Ring) Add(l Line) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.size <= 0 {
+		return
+	}
+
+	if len(r.lines) < r.size {
+		r.lines = append(r.lines, l)
+
+		return
+	}
+
+	r.lines[r.next] = l
+	r.next = (r.next + 1) % r.size
+}
+
+func (r *Ring) Lines() []Line {
+	r.Lock()
+	defer r.Unlock()
+
+	lines := make([]Line, 0, len(r.lines))
+	lines = append(lines, r.lines[r.next:]...)
+	lines = append(lines, r.lines[:r.next]...)
+
+	return lines
+}
+
+type lineWriter struct {
+	sync.Mutex
+
+	buf  []byte
+	emit func(text string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+
+		if i < 0 {
+			break
+		}
+
+		w.emit(string(bytes.TrimRight(w.buf[:i], "\r")))
+		w.buf = w.buf[i+1:]
+	}
+
+	if len(w.buf) >= MaxLineLength {
+		w.emit(string(w.buf))
+		w.buf = nil
+	}
+
+	return len(p), nil
+}
+
+func (w *lineWriter) Flush() {
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.buf) > 0 {
+		w.emit(string(w.buf))
+		w.buf = nil
+	}
+}
@@ -0,0 +1,136 @@
+package nurse
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClassifier(t *testing.T) {
+	lines := []struct {
+		text  string
+		level Level
+	}{
+		{"loading model", LevelInfo},
+		{"WARNING:root:slow tokenizer", LevelWarning},
+		{"Traceback (most recent call last):", LevelError},
+		{`  File "model.py", line 3, in <module>`, LevelError},
+		{"    raise ValueError()", LevelError},
+		{"ValueError", LevelError},
+		{"still alive", LevelInfo},
+		{"fatal: out of memory", LevelError},
+		{"terrorist", LevelInfo},
+	}
+
+	var c classifier
+
+	for _, l := range lines {
+		if level := c.classify(l.text); level != l.level {
+			t.Errorf("%q: %s; expected: %s", l.text, level, l.level)
+		}
+	}
+}
+
+func TestRing(t *testing.T) {
+	r := NewRing(3)
+
+	for i := 0; i < 5; i++ {
+		r.Add(Line{PID: i})
+	}
+
+	var pids []int
+
+	for _, l := range r.Lines() {
+		pids = append(pids, l.PID)
+	}
+
+	if !reflect.DeepEqual(pids, []int{2, 3, 4}) {
+		t.Errorf("pids: %v; expected: [2 3 4]", pids)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := lineWriter{emit: func(text string) { lines = append(lines, text) }}
+
+	w.Write([]byte("one\ntw"))
+	w.Write([]byte("o\r\nthr"))
+	w.Flush()
+	w.Write([]byte(strings.Repeat("x", MaxLineLength)))
+
+	expected := []string{"one", "two", "thr", strings.Repeat("x", MaxLineLength)}
+
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("lines: %q", lines)
+	}
+}
+
+func TestNurseOutput(t *testing.T) {
+	var mu sync.Mutex
+	var logged []Line
+
+	n := &Nurse{
+		Name:        "test",
+		Path:        "sh",
+		Args:        []string{"-c", `echo 'loading'; echo 'Traceback (most recent call last):' >&2; echo '{"hello":{"version":1}}'; exec cat`},
+		KillTimeout: time.Second,
+		OutputLines: 10,
+		Logger: func(l Line) {
+			mu.Lock()
+			logged = append(logged, l)
+			mu.Unlock()
+		},
+	}
+
+	startNurse(t, n)
+
+	if !waitFor(func() bool { return len(n.Output()) == 2 }, 5*time.Second) {
+		t.Fatalf("output: %q", n.Output())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	streams := map[string]Line{}
+
+	for _, l := range logged {
+		streams[l.Stream] = l
+	}
+
+	if l := streams["stdout"]; l.Text != "loading" || l.Level != LevelInfo || l.Nurse != "test" || l.PID == 0 {
+		t.Errorf("stdout: %#v", l)
+	}
+
+	if l := streams["stderr"]; l.Level != LevelError || l.PID == 0 {
+		t.Errorf("stderr: %#v", l)
+	}
+}
+
+func TestNurseOutputCurrentProcess(t *testing.T) {
+	n := &Nurse{
+		Path:        "sh",
+		Args:        []string{"-c", `echo "pid $$" >&2; echo '{"hello":{"version":1}}'; exec cat`},
+		KillTimeout: time.Second,
+		Logger:      func(Line) {},
+	}
+
+	startNurse(t, n)
+
+	if !waitFor(n.IsReady, 5*time.Second) {
+		t.Fatalf("Not ready")
+	}
+
+	pid := n.Status().PID
+	n.Recycle()
+
+	if !waitFor(func() bool { return n.IsReady() && n.Status().PID != pid && len(n.Output()) > 0 }, 5*time.Second) {
+		t.Fatalf("status: %+v; expected a new process", n.Status())
+	}
+
+	if output := n.Output(); len(output) != 1 || !strings.HasSuffix(output[0], fmt.Sprintf("pid %d", n.Status().PID)) {
+		t.Errorf("output: %q; expected only the output of the current process", output)
+	}
+}
@@ -0,0 +1,164 @@
+package nurse
+
+import (
+	"log"
+	"os/exec"
+	"time"
+
+	"deepbooru/ipc"
+)
+
+const DefaultInterruptGrace = 10 * time.Second
+
+type request struct {
+	id       int64
+	deadline time.Time
+}
+
+func (r *request) interrupted() bool {
+	return !r.deadline.IsZero()
+}
+
+func (n *Nurse) track(in <-chan deepbooru_ipc.Message, interrupt <-chan bool, done <-chan struct{}, out chan<- deepbooru_ipc.Message) {
+	defer close(out)
+
+	for {
+		var m deepbooru_ipc.Message
+
+		select {
+		case m = <-in:
+		case <-interrupt:
+			n.signalInterrupt()
+
+			continue
+		case <-done:
+			return
+		}
+
+		switch {
+		case m.Batch != nil:
+			n.Lock()
+
+			for i := range m.Batch {
+				n.outstanding = append(n.outstanding, &request{id: m.Batch[i].ID})
+			}
+
+			n.Unlock()
+		case m.Cancel:
+			n.Lock()
+			cmd := n.cmd
+			n.Unlock()
+
+			n.interrupted(cmd, m.ID)
+		case m.Interrupt || m.Shutdown:
+		default:
+			n.Lock()
+			n.outstanding = append(n.outstanding, &request{id: m.ID})
+			n.Unlock()
+		}
+
+		out <- m
+	}
+}
+
+func (n *Nurse) interrupted(cmd *exec.Cmd, id int64) {
+	grace := n.InterruptGrace
+
+	if grace <= 0 {
+		grace = DefaultInterruptGrace
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	if cmd == nil || cmd != n.cmd {
+		return
+	}
+
+	deadline := n.now().Add(grace)
+	marked := false
+
+	for _, r := range n.outstanding {
+		if (id == 0 || r.id == id) && !r.interrupted() {
+			r.deadline = deadline
+			marked = true
+		}
+	}
+
+	if marked {
+		time.AfterFunc(grace, func() { n.checkHung(cmd) })
+	}
+}
+
+func (n *Nurse) checkHung(cmd *exec.Cmd) {
+	n.Lock()
+	defer n.Unlock()
+
+	if cmd != n.cmd || !n.ready {
+		return
+	}
+
+	now := n.now()
+
+	for _, r := range n.outstanding {
+		if r.interrupted() && !now.Before(r.deadline) {
+			log.Printf("Process %d did not acknowledge an interrupt of request %d, killing", n.pid, r.id)
+			killGroup(cmd)
+
+			return
+		}
+	}
+}
+
+func (n *Nurse) settle(m *deepbooru_ipc.Message) bool {
+	n.Lock()
+	defer n.Unlock()
+
+	defer n.maybeRecycle()
+
+	if m.Batch == nil {
+		return n.complete(m.ID)
+	}
+
+	batch := m.Batch[:0]
+
+	for _, item := range m.Batch {
+		if n.complete(item.ID) {
+			batch = append(batch, item)
+		}
+	}
+
+	m.Batch = batch
+
+	return len(batch) > 0
+}
+
+func (n *Nurse) complete(id int64) bool {
+	for i, r := range n.outstanding {
+		if id != 0 && r.id != id {
+			continue
+		}
+
+		n.outstanding = append(n.outstanding[:i], n.outstanding[i+1:]...)
+
+		if r.interrupted() {
+			log.Printf("Discarding stale response to interrupted request %d", r.id)
+
+			return false
+		}
+
+		return true
+	}
+
+	log.Printf("Discarding response to unknown request %d", id)
+
+	return false
+}
+
+func (n *Nurse) abandon(lost []*request) {
+	for _, r := range lost {
+		if !r.interrupted() {
+			n.lost <- deepbooru_ipc.Message{ID: r.id, Terminated: true}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package nurse
+
+import (
+	"testing"
+	"time"
+
+	"deepbooru/ipc"
+)
+
+func TestNurseStaleResponse(t *testing.T) {
+	n := &Nurse{
+		Path:        "sh",
+		Args:        []string{"-c", `trap '' INT; ` + testHello + `; read a; read b; echo '{"error":"late"}'; echo '{"url":"second"}'; exec cat`},
+		KillTimeout: time.Second,
+	}
+
+	startNurse(t, n)
+
+	if !waitFor(n.IsReady, 5*time.Second) {
+		t.Fatalf("Not ready")
+	}
+
+	n.In() <- deepbooru_ipc.Message{ID: 1, URL: "first"}
+	n.Interrupt()
+	n.In() <- deepbooru_ipc.Message{ID: 2, URL: "second"}
+
+	if m := <-n.Out(); m.URL != "second" {
+		t.Errorf("message: %#v; expected the response to the second request", m)
+	}
+
+	if status := n.Status(); status.InFlight != 0 {
+		t.Errorf("status: %+v; expected no in-flight requests", status)
+	}
+}
+
+func TestNurseHungInterrupt(t *testing.T) {
+	n := &Nurse{
+		Path:           "sh",
+		Args:           []string{"-c", `trap '' INT; ` + testHello + `; read a; exec sleep 10`},
+		KillTimeout:    time.Second,
+		InterruptGrace: 100 * time.Millisecond,
+		MinBackoff:     10 * time.Millisecond,
+	}
+
+	startNurse(t, n)
+
+	if !waitFor(n.IsReady, 5*time.Second) {
+		t.Fatalf("Not ready")
+	}
+
+	pid := n.Status().PID
+	n.In() <- deepbooru_ipc.Message{ID: 1, URL: "first"}
+
+	if !waitFor(func() bool { return n.Status().InFlight == 1 }, time.Second) {
+		t.Fatalf("status: %+v; expected 1 in-flight request", n.Status())
+	}
+
+	n.Interrupt()
+
+	if !waitFor(func() bool { return n.IsReady() && n.Status().PID != pid }, 5*time.Second) {
+		t.Fatalf("status: %+v; expected a new process", n.Status())
+	}
+
+	if status := n.Status(); status.LastExitCode != -1 || status.InFlight != 0 {
+		t.Errorf("status: %+v", status)
+	}
+}
+
+func TestNurseAbandoned(t *testing.T) {
+	n := &Nurse{
+		Path:        "sh",
+		Args:        []string{"-c", testHello + `; read a; exit 1`},
+		KillTimeout: time.Second,
+		MinBackoff:  10 * time.Millisecond,
+	}
+
+	startNurse(t, n)
+
+	if !waitFor(n.IsReady, 5*time.Second) {
+		t.Fatalf("Not ready")
+	}
+
+	n.In() <- deepbooru_ipc.Message{ID: 5, URL: "first"}
+
+	if m := <-n.Out(); m.ID != 5 || !m.Terminated {
+		t.Errorf("message: %#v; expected request 5 to be terminated", m)
+	}
+}
@@ -0,0 +1,227 @@
+package nurse
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"deepbooru"
+)
+
+const DefaultWatchInterval = 5 * time.Second
+
+var ErrReloading = errors.New("reload already in progress")
+
+type Pool struct {
+	sync.Mutex
+
+	Nurses []*Nurse
+
+	PollInterval time.Duration
+
+	reloading bool
+}
+
+func (p *Pool) pollInterval() time.Duration {
+	if p.PollInterval <= 0 {
+		return 100 * time.Millisecond
+	}
+
+	return p.PollInterval
+}
+
+func (p *Pool) Reload(ctx context.Context) error {
+	p.Lock()
+
+	if p.reloading {
+		p.Unlock()
+
+		return ErrReloading
+	}
+
+	p.reloading = true
+	p.Unlock()
+
+	defer func() {
+		p.Lock()
+		p.reloading = false
+		p.Unlock()
+	}()
+
+	nurses := p.snapshot()
+
+	log.Printf("Reloading %d processes", len(nurses))
+
+	for i, n := range nurses {
+		err := p.waitFor(ctx, func() bool { return othersReady(nurses, i) })
+
+		if err != nil {
+			return err
+		}
+
+		restarts := n.Status().Restarts
+		n.Recycle()
+
+		err = p.waitFor(ctx, func() bool {
+			return n.IsReady() && n.Status().Restarts > restarts
+		})
+
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Reloaded process %d of %d", i+1, len(nurses))
+	}
+
+	if len(nurses) == 0 {
+		return nil
+	}
+
+	hello := nurses[len(nurses)-1].Hello()
+
+	if hello == nil {
+		return deepbooru.ErrTerminated
+	}
+
+	log.Printf("Reload complete, model %s %s", hello.Model, hello.ModelVersion)
+
+	return nil
+}
+
+func (p *Pool) snapshot() []*Nurse {
+	p.Lock()
+	defer p.Unlock()
+
+	return append([]*Nurse(nil), p.Nurses...)
+}
+
+func (p *Pool) Add(n *Nurse) {
+	p.Lock()
+	p.Nurses = append(p.Nurses, n)
+	p.Unlock()
+}
+
+func (p *Pool) Remove(n *Nurse) {
+	p.Lock()
+	defer p.Unlock()
+
+	for i, m := range p.Nurses {
+		if m == n {
+			p.Nurses = append(p.Nurses[:i:i], p.Nurses[i+1:]...)
+
+			return
+		}
+	}
+}
+
+func (p *Pool) Size() int {
+	p.Lock()
+	defer p.Unlock()
+
+	return len(p.Nurses)
+}
+
+func othersReady(nurses []*Nurse, i int) bool {
+	for j, n := range nurses {
+		if j != i && !n.IsReady() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *Pool) waitFor(ctx context.Context, cond func() bool) error {
+	ticker := time.NewTicker(p.pollInterval())
+
+	defer ticker.Stop()
+
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+func (p *Pool) Model() (name, version string) {
+	found := false
+
+	for _, n := range p.snapshot() {
+		hello := n.Hello()
+
+		if hello == nil {
+			continue
+		}
+
+		if !found {
+			name, version, found = hello.Model, hello.ModelVersion, true
+
+			continue
+		}
+
+		if hello.Model != name {
+			return "", ""
+		}
+
+		if hello.ModelVersion != version {
+			version = ""
+		}
+	}
+
+	return name, version
+}
+
+func (p *Pool) Watch(ctx context.Context, path string, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	last, _ := os.Stat(path)
+	changed := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+
+		if err != nil {
+			continue
+		}
+
+		if last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+			last = info
+			changed = true
+
+			continue
+		}
+
+		if !changed {
+			continue
+		}
+
+		changed = false
+
+		log.Printf("%s changed, reloading", path)
+
+		err = p.Reload(ctx)
+
+		if err != nil {
+			log.Printf("Failed to reload: %s", err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package nurse
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startPool(t *testing.T, size int) (*Pool, string) {
+	version := filepath.Join(t.TempDir(), "version")
+	script := `echo "{\"hello\":{\"version\":1,\"model\":\"test\",\"model_version\":\"$(cat ` + version + `)\"}}"; exec cat`
+	p := &Pool{PollInterval: 10 * time.Millisecond}
+
+	err := ioutil.WriteFile(version, []byte("1"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < size; i++ {
+		n := &Nurse{
+			Path:        "sh",
+			Args:        []string{"-c", script},
+			KillTimeout: time.Second,
+		}
+		p.Nurses = append(p.Nurses, n)
+
+		startNurse(t, n)
+	}
+
+	for _, n := range p.Nurses {
+		if !waitFor(n.IsReady, 5*time.Second) {
+			t.Fatalf("Not ready")
+		}
+	}
+
+	if model, version := p.Model(); model != "test" || version != "1" {
+		t.Fatalf("model: %s %s; expected: test 1", model, version)
+	}
+
+	return p, version
+}
+
+func TestPoolReload(t *testing.T) {
+	p, version := startPool(t, 3)
+	ioutil.WriteFile(version, []byte("2"), 0644)
+
+	var minReady int32 = 3
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			ready := 0
+
+			for _, n := range p.Nurses {
+				if n.IsReady() {
+					ready++
+				}
+			}
+
+			if int32(ready) < atomic.LoadInt32(&minReady) {
+				atomic.StoreInt32(&minReady, int32(ready))
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := p.Reload(ctx)
+	close(done)
+
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if ready := atomic.LoadInt32(&minReady); ready < 2 {
+		t.Errorf("only %d processes were ready during reload", ready)
+	}
+
+	if model, version := p.Model(); model != "test" || version != "2" {
+		t.Errorf("model: %s %s; expected: test 2", model, version)
+	}
+
+	for _, n := range p.Nurses {
+		if status := n.Status(); status.Restarts != 1 {
+			t.Errorf("status: %+v; expected 1 restart", status)
+		}
+	}
+}
+
+func TestPoolWatch(t *testing.T) {
+	p, version := startPool(t, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	defer cancel()
+
+	go p.Watch(ctx, version, 20*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	ioutil.WriteFile(version, []byte("22"), 0644)
+
+	if !waitFor(func() bool { _, version := p.Model(); return version == "22" }, 10*time.Second) {
+		t.Errorf("model was not reloaded")
+	}
+}
+
+func TestPoolModelAfterRestart(t *testing.T) {
+	p, version := startPool(t, 1)
+	ioutil.WriteFile(version, []byte("3"), 0644)
+
+	p.Nurses[0].Recycle()
+
+	if !waitFor(func() bool { _, version := p.Model(); return version == "3" }, 10*time.Second) {
+		t.Errorf("model: %v; expected the restarted process to be advertised", p.Nurses[0].Hello())
+	}
+}
+
+func TestPoolModelPartialReload(t *testing.T) {
+	p, version := startPool(t, 2)
+	ioutil.WriteFile(version, []byte("4"), 0644)
+
+	restarts := p.Nurses[0].Status().Restarts
+	p.Nurses[0].Recycle()
+
+	if !waitFor(func() bool { return p.Nurses[0].IsReady() && p.Nurses[0].Status().Restarts > restarts }, 10*time.Second) {
+		t.Fatalf("status: %+v; expected the first process to restart", p.Nurses[0].Status())
+	}
+
+	if name, version := p.Model(); name != "test" || version != "" {
+		t.Errorf("model: %s %s; expected no version while processes disagree", name, version)
+	}
+
+	p.Nurses[1].Recycle()
+
+	if !waitFor(func() bool { _, version := p.Model(); return version == "4" }, 10*time.Second) {
+		t.Errorf("model: %v; expected the new version once every process serves it", p.Nurses[1].Hello())
+	}
+}
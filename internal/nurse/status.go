@@ -0,0 +1,126 @@
+package nurse
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const DefaultMinBackoff = time.Second
+const DefaultMaxBackoff = time.Minute
+
+var ErrCrashLoop = errors.New("process is crash looping")
+var ErrInvalidPolicy = errors.New("invalid restart policy")
+
+type RestartPolicy int
+
+const (
+	RestartAlways RestartPolicy = iota
+	RestartOnFailure
+	RestartNever
+)
+
+func ParseRestartPolicy(s string) (RestartPolicy, error) {
+	switch s {
+	case "always", "":
+		return RestartAlways, nil
+	case "on-failure":
+		return RestartOnFailure, nil
+	case "never":
+		return RestartNever, nil
+	}
+
+	return RestartAlways, fmt.Errorf("%w: %q", ErrInvalidPolicy, s)
+}
+
+func (p RestartPolicy) String() string {
+	switch p {
+	case RestartOnFailure:
+		return "on-failure"
+	case RestartNever:
+		return "never"
+	default:
+		return "always"
+	}
+}
+
+func (p RestartPolicy) restart(code int) bool {
+	switch p {
+	case RestartOnFailure:
+		return code != 0
+	case RestartNever:
+		return false
+	default:
+		return true
+	}
+}
+
+type State int
+
+const (
+	Stopped State = iota
+	Starting
+	Ready
+	Backoff
+	Exited
+	CrashLoop
+)
+
+func (s State) String() string {
+	switch s {
+	case Starting:
+		return "starting"
+	case Ready:
+		return "ready"
+	case Backoff:
+		return "backoff"
+	case Exited:
+		return "exited"
+	case CrashLoop:
+		return "crash-loop"
+	default:
+		return "stopped"
+	}
+}
+
+type Status struct {
+	State          State
+	PID            int
+	Restarts       int
+	FailedRestarts int
+	LastExitCode   int
+	LastExit       time.Time
+	LastError      string
+	NextRestart    time.Time
+	InFlight       int
+	Recycling      bool
+	RSS            uint64
+	ForceKilled    []int
+}
+
+func backoff(failures int, min, max time.Duration) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+
+	if min <= 0 {
+		min = DefaultMinBackoff
+	}
+
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+
+	d := min
+
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,393 @@
+package http_processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"deepbooru"
+	"deepbooru/internal/resolver"
+)
+
+const DefaultMaxConnections = 4
+const DefaultMaxSize = 32 << 20
+
+const (
+	ModeURL    = "url"
+	ModeBinary = "binary"
+)
+
+var ErrUnavailable = fmt.Errorf("%w: model server", deepbooru.ErrUnavailable)
+var ErrMapping = errors.New("response does not match the tag mapping")
+
+type Mapping struct {
+	Tags  string
+	Name  string
+	Score string
+}
+
+type Processor struct {
+	sync.Mutex
+
+	URL            string
+	Client         *http.Client
+	Header         http.Header
+	Mode           string
+	Field          string
+	Resolver       resolver.Resolver
+	MaxSize        int64
+	MaxConnections int
+	Mapping        Mapping
+
+	busy int
+}
+
+func New(url string, maxConnections int) *Processor {
+	if maxConnections <= 0 {
+		maxConnections = DefaultMaxConnections
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = maxConnections
+	transport.MaxIdleConnsPerHost = maxConnections
+
+	return &Processor{
+		URL:            url,
+		Client:         &http.Client{Transport: transport},
+		MaxConnections: maxConnections,
+	}
+}
+
+func (p *Processor) setBusy(b bool) {
+	p.Lock()
+
+	if b {
+		p.busy++
+	} else {
+		p.busy--
+	}
+
+	p.Unlock()
+}
+
+func done(ctx context.Context) <-chan struct{} {
+	if ctx == nil {
+		return nil
+	}
+
+	return ctx.Done()
+}
+
+func (p *Processor) Process(global, local context.Context, timeout time.Duration, url string) ([]deepbooru.Tag, error) {
+	p.setBusy(true)
+	defer p.setBusy(false)
+
+	ctx, cancel := context.WithCancel(local)
+
+	defer cancel()
+
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+
+		defer cancel()
+	}
+
+	go func() {
+		select {
+		case <-done(global):
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	tags, err := p.process(ctx, url)
+
+	switch {
+	case err == nil:
+		return tags, nil
+	case global != nil && global.Err() != nil:
+		return nil, deepbooru.ErrTerminated
+	case local.Err() != nil:
+		return nil, deepbooru.ErrCancelled
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return nil, deepbooru.ErrTimeout
+	}
+
+	return nil, err
+}
+
+func (p *Processor) process(ctx context.Context, url string) ([]deepbooru.Tag, error) {
+	req, err := p.request(ctx, url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client := p.Client
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	err = status(resp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var body interface{}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMapping, err)
+	}
+
+	return p.Mapping.tags(body)
+}
+
+func (p *Processor) request(ctx context.Context, url string) (*http.Request, error) {
+	if p.Mode != ModeBinary {
+		field := p.Field
+
+		if field == "" {
+			field = "url"
+		}
+
+		body, err := json.Marshal(map[string]string{field: url})
+
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", p.URL, bytes.NewReader(body))
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.header(req, "application/json")
+
+		return req, nil
+	}
+
+	data, err := p.fetch(ctx, url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.URL, bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.header(req, http.DetectContentType(data))
+
+	return req, nil
+}
+
+func (p *Processor) header(req *http.Request, contentType string) {
+	for name, values := range p.Header {
+		req.Header[name] = values
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+}
+
+func (p *Processor) fetch(ctx context.Context, url string) ([]byte, error) {
+	if p.Resolver == nil {
+		return nil, resolver.ErrUnsupportedScheme
+	}
+
+	maxSize := p.MaxSize
+
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	r, err := p.Resolver.Resolve(ctx, url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > maxSize {
+		return nil, deepbooru.ErrInvalid
+	}
+
+	return data, nil
+}
+
+func status(resp *http.Response) error {
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == 408 || resp.StatusCode == 504:
+		return deepbooru.ErrTimeout
+	case resp.StatusCode == 429 || resp.StatusCode == 502 || resp.StatusCode == 503:
+		return fmt.Errorf("%w: %s", ErrUnavailable, resp.Status)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return fmt.Errorf("%w: %s: %s", deepbooru.ErrInvalid, resp.Status, snippet(resp.Body))
+	}
+
+	return fmt.Errorf("model server error: %s: %s", resp.Status, snippet(resp.Body))
+}
+
+func snippet(r io.Reader) string {
+	data, _ := ioutil.ReadAll(io.LimitReader(r, 256))
+
+	return strings.TrimSpace(string(data))
+}
+
+func (m Mapping) tags(body interface{}) ([]deepbooru.Tag, error) {
+	value, err := lookup(body, m.Tags)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		tags := make([]deepbooru.Tag, 0, len(value))
+
+		for name, score := range value {
+			s, ok := score.(float64)
+
+			if !ok {
+				return nil, fmt.Errorf("%w: score of %q is not a number", ErrMapping, name)
+			}
+
+			tags = append(tags, deepbooru.Tag{Name: name, Score: float32(s)})
+		}
+
+		return tags, nil
+	case []interface{}:
+		tags := make([]deepbooru.Tag, 0, len(value))
+
+		for i := range value {
+			tag, err := m.tag(value[i])
+
+			if err != nil {
+				return nil, err
+			}
+
+			tags = append(tags, tag)
+		}
+
+		return tags, nil
+	}
+
+	return nil, fmt.Errorf("%w: %q is not a list or an object", ErrMapping, m.Tags)
+}
+
+func (m Mapping) tag(value interface{}) (deepbooru.Tag, error) {
+	nameField, scoreField := m.Name, m.Score
+
+	if nameField == "" {
+		nameField = "name"
+	}
+
+	if scoreField == "" {
+		scoreField = "score"
+	}
+
+	name, err := lookup(value, nameField)
+
+	if err != nil {
+		return deepbooru.Tag{}, err
+	}
+
+	score, err := lookup(value, scoreField)
+
+	if err != nil {
+		return deepbooru.Tag{}, err
+	}
+
+	n, ok := name.(string)
+	s, sok := score.(float64)
+
+	if !ok || !sok {
+		return deepbooru.Tag{}, fmt.Errorf("%w: invalid tag %v", ErrMapping, value)
+	}
+
+	return deepbooru.Tag{Name: n, Score: float32(s)}, nil
+}
+
+func lookup(value interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return value, nil
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[key]
+
+			if !ok {
+				return nil, fmt.Errorf("%w: missing %q", ErrMapping, path)
+			}
+
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("%w: missing %q", ErrMapping, path)
+			}
+
+			value = v[i]
+		default:
+			return nil, fmt.Errorf("%w: missing %q", ErrMapping, path)
+		}
+	}
+
+	return value, nil
+}
+
+func (p *Processor) Capacity() int {
+	p.Lock()
+	defer p.Unlock()
+
+	max := p.MaxConnections
+
+	if max <= 0 {
+		max = DefaultMaxConnections
+	}
+
+	if p.busy >= max {
+		return 0
+	}
+
+	return max - p.busy
+}
+
+func (p *Processor) IsReady() bool {
+	return p != nil && p.URL != ""
+}
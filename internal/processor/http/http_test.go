@@ -0,0 +1,290 @@
+package http_processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"deepbooru"
+	"deepbooru/internal/resolver"
+)
+
+func TestProcessURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["image"] != "http://example.com/a.jpg" {
+			w.WriteHeader(400)
+
+			return
+		}
+
+		w.Write([]byte(`{"result":{"predictions":[{"label":"cat","confidence":0.9},{"label":"dog","confidence":0.25}]}}`))
+	}))
+	defer server.Close()
+
+	p := New(server.URL, 2)
+	p.Field = "image"
+	p.Mapping = Mapping{Tags: "result.predictions", Name: "label", Score: "confidence"}
+
+	tags, err := p.Process(context.Background(), context.Background(), time.Second, "http://example.com/a.jpg")
+
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []deepbooru.Tag{{Name: "cat", Score: 0.9}, {Name: "dog", Score: 0.25}}
+
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("tags: %v; expected: %v", tags, expected)
+	}
+}
+
+func TestProcessBinary(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+
+		if string(data) != "image" {
+			w.WriteHeader(415)
+
+			return
+		}
+
+		w.Write([]byte(`{"1girl":0.75,"solo":0.5}`))
+	}))
+	defer server.Close()
+
+	p := New(server.URL, 1)
+	p.Mode = ModeBinary
+	p.Resolver = resolver.Data{}
+
+	tags, err := p.Process(context.Background(), context.Background(), time.Second, resolver.DataURL("image/png", []byte("image")))
+
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	expected := []deepbooru.Tag{{Name: "1girl", Score: 0.75}, {Name: "solo", Score: 0.5}}
+
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("tags: %v; expected: %v", tags, expected)
+	}
+}
+
+func TestProcessStatus(t *testing.T) {
+	cases := []struct {
+		status int
+		err    error
+	}{
+		{400, deepbooru.ErrInvalid},
+		{422, deepbooru.ErrInvalid},
+		{408, deepbooru.ErrTimeout},
+		{504, deepbooru.ErrTimeout},
+		{503, ErrUnavailable},
+		{503, deepbooru.ErrUnavailable},
+	}
+
+	for _, c := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c.status)
+		}))
+
+		p := New(server.URL, 1)
+		_, err := p.Process(context.Background(), context.Background(), time.Second, "http://example.com")
+
+		if !errors.Is(err, c.err) {
+			t.Errorf("%d: err: %v; expected: %v", c.status, err, c.err)
+		}
+
+		server.Close()
+	}
+}
+
+func TestProcessMappingError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"tags":"none"}`))
+	}))
+	defer server.Close()
+
+	p := New(server.URL, 1)
+	p.Mapping.Tags = "tags"
+
+	if _, err := p.Process(context.Background(), context.Background(), time.Second, "http://example.com"); !errors.Is(err, ErrMapping) {
+		t.Errorf("err: %v; expected: ErrMapping", err)
+	}
+}
+
+func TestProcessContexts(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	p := New(server.URL, 2)
+
+	if _, err := p.Process(context.Background(), context.Background(), 20*time.Millisecond, "http://example.com"); err != deepbooru.ErrTimeout {
+		t.Errorf("timeout: err: %v; expected: ErrTimeout", err)
+	}
+
+	local, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	if _, err := p.Process(context.Background(), local, 0, "http://example.com"); err != deepbooru.ErrCancelled {
+		t.Errorf("local: err: %v; expected: ErrCancelled", err)
+	}
+
+	global, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	if _, err := p.Process(global, context.Background(), 0, "http://example.com"); err != deepbooru.ErrTerminated {
+		t.Errorf("global: err: %v; expected: ErrTerminated", err)
+	}
+
+	if _, err := p.Process(nil, context.Background(), 20*time.Millisecond, "http://example.com"); err != deepbooru.ErrTimeout {
+		t.Errorf("no global: err: %v; expected: ErrTimeout", err)
+	}
+}
+
+type testBus struct {
+	deepbooru.Bus
+
+	codes chan deepbooru.ErrorCode
+}
+
+func (b *testBus) Beat(id, attempt int64) error {
+	return nil
+}
+
+func (b *testBus) Error(id, attempt int64, code deepbooru.ErrorCode, reason string) error {
+	select {
+	case b.codes <- code:
+	default:
+	}
+
+	return nil
+}
+
+func (b *testBus) Deschedule(leases []deepbooru.Lease) error {
+	return nil
+}
+
+func (b *testBus) WorkerStatus(status deepbooru.WorkerInfo) error {
+	return nil
+}
+
+type testBusFactory struct {
+	bus *testBus
+}
+
+func (f *testBusFactory) Publish() deepbooru.Bus {
+	return f.bus
+}
+
+func (f *testBusFactory) SubscribeAll(bus deepbooru.Bus, consume bool, types ...string) (deepbooru.Terminator, error) {
+	return func() {}, nil
+}
+
+func (f *testBusFactory) SubscribeOne(bus deepbooru.Bus, consume bool, id int64, types ...string) (deepbooru.Terminator, error) {
+	return func() {}, nil
+}
+
+func TestWorkerBadRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		w.Write([]byte("unsupported image"))
+	}))
+	defer server.Close()
+
+	bus := &testBus{codes: make(chan deepbooru.ErrorCode, 1)}
+	w := deepbooru.NewWorker(&testBusFactory{bus})
+	w.Name = "node"
+	w.Processor = New(server.URL, 1)
+	w.TickInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+
+	go func() {
+		result <- w.Run(ctx)
+	}()
+
+	defer func() {
+		cancel()
+		<-result
+	}()
+
+	deadline := time.After(5 * time.Second)
+
+	for {
+		err := w.OnSchedule("node", []deepbooru.Info{{ID: 1, Attempt: 1, URL: "http://example.com/a.jpg"}})
+
+		if err != nil {
+			t.Fatalf("schedule: %s", err)
+		}
+
+		select {
+		case code := <-bus.codes:
+			if code != deepbooru.Invalid {
+				t.Errorf("code: %v; expected: Invalid", code)
+			}
+
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("the job was not reported")
+		}
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	p := New(server.URL, 3)
+
+	if capacity := p.Capacity(); capacity != 3 {
+		t.Errorf("capacity: %d; expected: 3", capacity)
+	}
+
+	done := make(chan error)
+
+	go func() {
+		_, err := p.Process(context.Background(), context.Background(), time.Second, "http://example.com")
+		done <- err
+	}()
+
+	<-started
+
+	if capacity := p.Capacity(); capacity != 2 {
+		t.Errorf("capacity: %d; expected: 2", capacity)
+	}
+
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Errorf("err: %s", err)
+	}
+
+	if capacity := p.Capacity(); capacity != 3 {
+		t.Errorf("capacity: %d; expected: 3", capacity)
+	}
+}
@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"deepbooru"
+)
+
+const DefaultBreakerCooldown = 30 * time.Second
+
+var ErrOpen = fmt.Errorf("%w: circuit breaker is open", deepbooru.ErrUnavailable)
+
+type CircuitBreaker struct {
+	sync.Mutex
+	deepbooru.Processor
+
+	Threshold int
+	Cooldown  time.Duration
+
+	failures int
+	openedAt time.Time
+	open     bool
+	trial    bool
+	now      func() time.Time
+}
+
+func (b *CircuitBreaker) time() time.Time {
+	if b.now == nil {
+		return time.Now()
+	}
+
+	return b.now()
+}
+
+func (b *CircuitBreaker) cooldown() time.Duration {
+	if b.Cooldown <= 0 {
+		return DefaultBreakerCooldown
+	}
+
+	return b.Cooldown
+}
+
+func (b *CircuitBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.open {
+		return true
+	}
+
+	if b.trial || b.time().Sub(b.openedAt) < b.cooldown() {
+		return false
+	}
+
+	b.trial = true
+
+	return true
+}
+
+func (b *CircuitBreaker) record(err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.trial = false
+
+	if !failure(err) {
+		if b.open {
+			log.Printf("Circuit breaker closed")
+		}
+
+		b.failures = 0
+		b.open = false
+
+		return
+	}
+
+	b.failures++
+
+	if b.open || b.failures >= b.Threshold {
+		if !b.open {
+			log.Printf("Circuit breaker opened after %d consecutive failures: %s", b.failures, err)
+		}
+
+		b.open = true
+		b.openedAt = b.time()
+	}
+}
+
+func failure(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, deepbooru.ErrUnavailable), errors.Is(err, deepbooru.ErrTerminated):
+		return true
+	case errors.Is(err, deepbooru.ErrCancelled),
+		errors.Is(err, deepbooru.ErrTimeout),
+		errors.Is(err, deepbooru.ErrInvalid),
+		errors.Is(err, deepbooru.ErrPartial),
+		errors.Is(err, deepbooru.ErrNotFound),
+		errors.Is(err, deepbooru.ErrStale):
+		return false
+	}
+
+	return true
+}
+
+func stopped(ctx context.Context) bool {
+	return ctx != nil && ctx.Err() != nil
+}
+
+func (b *CircuitBreaker) Process(global, local context.Context, timeout time.Duration, url string) ([]deepbooru.Tag, error) {
+	if !b.allow() {
+		return nil, ErrOpen
+	}
+
+	tags, err := b.Processor.Process(global, local, timeout, url)
+
+	if errors.Is(err, deepbooru.ErrTerminated) && stopped(global) {
+		b.Lock()
+		b.trial = false
+		b.Unlock()
+
+		return tags, err
+	}
+
+	b.record(err)
+
+	return tags, err
+}
+
+func (b *CircuitBreaker) IsOpen() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.open
+}
+
+func (b *CircuitBreaker) Capacity() int {
+	b.Lock()
+	open := b.open && (b.trial || b.time().Sub(b.openedAt) < b.cooldown())
+	b.Unlock()
+
+	if open {
+		return 0
+	}
+
+	return b.Processor.Capacity()
+}
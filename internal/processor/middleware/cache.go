@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"deepbooru"
+)
+
+type Cache struct {
+	sync.Mutex
+	deepbooru.Processor
+
+	Size int
+	TTL  time.Duration
+
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+type cacheEntry struct {
+	url     string
+	tags    []deepbooru.Tag
+	expires time.Time
+}
+
+func (c *Cache) time() time.Time {
+	if c.now == nil {
+		return time.Now()
+	}
+
+	return c.now()
+}
+
+func (c *Cache) get(url string) ([]deepbooru.Tag, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[url]
+
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*cacheEntry)
+
+	if !entry.expires.IsZero() && !c.time().Before(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, url)
+
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e)
+
+	return append([]deepbooru.Tag(nil), entry.tags...), true
+}
+
+func (c *Cache) put(url string, tags []deepbooru.Tag) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+		c.lru = list.New()
+	}
+
+	entry := &cacheEntry{url: url, tags: append([]deepbooru.Tag(nil), tags...)}
+
+	if c.TTL > 0 {
+		entry.expires = c.time().Add(c.TTL)
+	}
+
+	if e, ok := c.entries[url]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+
+		return
+	}
+
+	c.entries[url] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).url)
+	}
+}
+
+func (c *Cache) Process(global, local context.Context, timeout time.Duration, url string) ([]deepbooru.Tag, error) {
+	if tags, ok := c.get(url); ok {
+		return tags, nil
+	}
+
+	tags, err := c.Processor.Process(global, local, timeout, url)
+
+	if err == nil && c.Size > 0 {
+		c.put(url, tags)
+	}
+
+	return tags, err
+}
+
+func (c *Cache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.lru == nil {
+		return 0
+	}
+
+	return c.lru.Len()
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"deepbooru"
+)
+
+type Stats struct {
+	Calls   int
+	Errors  int
+	Total   time.Duration
+	Slowest time.Duration
+}
+
+func (s Stats) Mean() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+
+	return s.Total / time.Duration(s.Calls)
+}
+
+type Metrics struct {
+	sync.Mutex
+	deepbooru.Processor
+
+	Observe func(url string, d time.Duration, err error)
+
+	stats Stats
+}
+
+func (m *Metrics) Process(global, local context.Context, timeout time.Duration, url string) ([]deepbooru.Tag, error) {
+	start := time.Now()
+	tags, err := m.Processor.Process(global, local, timeout, url)
+	d := time.Since(start)
+
+	m.Lock()
+	m.stats.Calls++
+	m.stats.Total += d
+
+	if err != nil {
+		m.stats.Errors++
+	}
+
+	if d > m.stats.Slowest {
+		m.stats.Slowest = d
+	}
+
+	m.Unlock()
+
+	if m.Observe != nil {
+		m.Observe(url, d, err)
+	} else if err != nil {
+		log.Printf("Processed %.64s in %s: %s", url, d, err)
+	} else {
+		log.Printf("Processed %.64s in %s", url, d)
+	}
+
+	return tags, err
+}
+
+func (m *Metrics) Stats() Stats {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.stats
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"time"
+
+	"deepbooru"
+)
+
+type Middleware func(p deepbooru.Processor) deepbooru.Processor
+
+func Chain(p deepbooru.Processor, middlewares ...Middleware) deepbooru.Processor {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		p = middlewares[i](p)
+	}
+
+	return p
+}
+
+type Config struct {
+	Metrics bool
+
+	CacheSize int
+	CacheTTL  time.Duration
+
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	Retries      int
+	RetryBackoff time.Duration
+	RetryErrors  []error
+}
+
+func (c Config) Middlewares() []Middleware {
+	var middlewares []Middleware
+
+	if c.Metrics {
+		middlewares = append(middlewares, func(p deepbooru.Processor) deepbooru.Processor {
+			return &Metrics{Processor: p}
+		})
+	}
+
+	if c.CacheSize > 0 {
+		middlewares = append(middlewares, func(p deepbooru.Processor) deepbooru.Processor {
+			return &Cache{Processor: p, Size: c.CacheSize, TTL: c.CacheTTL}
+		})
+	}
+
+	if c.BreakerThreshold > 0 {
+		middlewares = append(middlewares, func(p deepbooru.Processor) deepbooru.Processor {
+			return &CircuitBreaker{Processor: p, Threshold: c.BreakerThreshold, Cooldown: c.BreakerCooldown}
+		})
+	}
+
+	if c.Retries > 0 {
+		middlewares = append(middlewares, func(p deepbooru.Processor) deepbooru.Processor {
+			return &Retry{Processor: p, Attempts: c.Retries + 1, Backoff: c.RetryBackoff, Errors: c.RetryErrors}
+		})
+	}
+
+	return middlewares
+}
+
+func (c Config) Build(p deepbooru.Processor) deepbooru.Processor {
+	return Chain(p, c.Middlewares()...)
+}
@@ -0,0 +1,301 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"deepbooru"
+)
+
+type testProcessor struct {
+	sync.Mutex
+
+	errors []error
+	calls  int
+}
+
+func (p *testProcessor) Process(global, local context.Context, timeout time.Duration, url string) ([]deepbooru.Tag, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.calls++
+
+	if len(p.errors) > 0 {
+		err := p.errors[0]
+		p.errors = p.errors[1:]
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return []deepbooru.Tag{{Name: url, Score: 1}}, nil
+}
+
+func (p *testProcessor) Capacity() int {
+	return 1
+}
+
+func (p *testProcessor) IsReady() bool {
+	return true
+}
+
+func (p *testProcessor) Calls() int {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.calls
+}
+
+func process(p deepbooru.Processor, url string) ([]deepbooru.Tag, error) {
+	return p.Process(context.Background(), context.Background(), 0, url)
+}
+
+func TestRetry(t *testing.T) {
+	cases := []struct {
+		name   string
+		errors []error
+		err    error
+		calls  int
+	}{
+		{"transient", []error{deepbooru.ErrTerminated, deepbooru.ErrTimeout}, nil, 3},
+		{"exhausted", []error{deepbooru.ErrTerminated, deepbooru.ErrTerminated, deepbooru.ErrTerminated}, deepbooru.ErrTerminated, 3},
+		{"permanent", []error{deepbooru.ErrInvalid}, deepbooru.ErrInvalid, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			inner := &testProcessor{errors: c.errors}
+			p := &Retry{Processor: inner, Attempts: 3, Backoff: time.Millisecond}
+
+			if _, err := process(p, "a"); err != c.err {
+				t.Errorf("err: %v; expected: %v", err, c.err)
+			}
+
+			if inner.Calls() != c.calls {
+				t.Errorf("calls: %d; expected: %d", inner.Calls(), c.calls)
+			}
+		})
+	}
+}
+
+func TestRetryCancel(t *testing.T) {
+	inner := &testProcessor{errors: []error{deepbooru.ErrTerminated, deepbooru.ErrTerminated}}
+	p := &Retry{Processor: inner, Attempts: 3, Backoff: time.Hour}
+	local, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+
+	defer cancel()
+
+	if _, err := p.Process(context.Background(), local, 0, "a"); err != deepbooru.ErrCancelled {
+		t.Errorf("err: %v; expected: ErrCancelled", err)
+	}
+}
+
+type testSlowProcessor struct {
+	testProcessor
+
+	timeouts []time.Duration
+}
+
+func (p *testSlowProcessor) Process(global, local context.Context, timeout time.Duration, url string) ([]deepbooru.Tag, error) {
+	p.Lock()
+	p.timeouts = append(p.timeouts, timeout)
+	p.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	return nil, deepbooru.ErrTimeout
+}
+
+func TestRetryDeadline(t *testing.T) {
+	inner := &testSlowProcessor{}
+	p := &Retry{Processor: inner, Attempts: 10, Backoff: time.Millisecond}
+	start := time.Now()
+
+	if _, err := p.Process(context.Background(), context.Background(), 50*time.Millisecond, "a"); err != deepbooru.ErrTimeout {
+		t.Errorf("err: %v; expected: ErrTimeout", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("elapsed: %s; expected the retries to share the timeout", elapsed)
+	}
+
+	if len(inner.timeouts) < 2 || len(inner.timeouts) > 4 {
+		t.Fatalf("timeouts: %v; expected 2-4 attempts within the timeout", inner.timeouts)
+	}
+
+	for i := 1; i < len(inner.timeouts); i++ {
+		if inner.timeouts[i] >= inner.timeouts[i-1] {
+			t.Errorf("timeouts: %v; expected each attempt to get the remaining time", inner.timeouts)
+		}
+	}
+}
+
+func TestCircuitBreakerUnavailable(t *testing.T) {
+	if !errors.Is(ErrOpen, deepbooru.ErrUnavailable) {
+		t.Errorf("ErrOpen is not ErrUnavailable")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	failed := errors.New("failed")
+	inner := &testProcessor{errors: []error{failed, deepbooru.ErrInvalid, failed, failed, failed, failed}}
+	now := time.Unix(0, 0)
+	b := &CircuitBreaker{Processor: inner, Threshold: 3, Cooldown: time.Minute, now: func() time.Time { return now }}
+
+	for i := 0; i < 5; i++ {
+		process(b, "a")
+	}
+
+	if !b.IsOpen() || b.Capacity() != 0 {
+		t.Fatalf("open: %v, capacity: %d; expected the breaker to open", b.IsOpen(), b.Capacity())
+	}
+
+	if _, err := process(b, "a"); err != ErrOpen {
+		t.Errorf("err: %v; expected: ErrOpen", err)
+	}
+
+	if inner.Calls() != 5 {
+		t.Errorf("calls: %d; expected: 5", inner.Calls())
+	}
+
+	now = now.Add(time.Minute)
+
+	if b.Capacity() != 1 {
+		t.Errorf("capacity: %d; expected a trial after the cooldown", b.Capacity())
+	}
+
+	if _, err := process(b, "a"); err != failed {
+		t.Errorf("err: %v; expected the trial to fail", err)
+	}
+
+	if _, err := process(b, "a"); err != ErrOpen {
+		t.Errorf("err: %v; expected the breaker to reopen", err)
+	}
+
+	now = now.Add(time.Minute)
+
+	if _, err := process(b, "a"); err != nil {
+		t.Errorf("err: %v; expected the trial to succeed", err)
+	}
+
+	if b.IsOpen() || b.Capacity() != 1 {
+		t.Errorf("open: %v, capacity: %d; expected the breaker to close", b.IsOpen(), b.Capacity())
+	}
+}
+
+func TestCache(t *testing.T) {
+	inner := &testProcessor{errors: []error{deepbooru.ErrTerminated}}
+	now := time.Unix(0, 0)
+	c := &Cache{Processor: inner, Size: 2, TTL: time.Minute, now: func() time.Time { return now }}
+
+	if _, err := process(c, "a"); err != deepbooru.ErrTerminated {
+		t.Errorf("err: %v; expected: ErrTerminated", err)
+	}
+
+	for _, url := range []string{"a", "a", "b", "a", "c", "a", "b"} {
+		tags, err := process(c, url)
+
+		if err != nil || len(tags) != 1 || tags[0].Name != url {
+			t.Errorf("%s: tags: %v, err: %v", url, tags, err)
+		}
+	}
+
+	if inner.Calls() != 5 || c.Len() != 2 {
+		t.Errorf("calls: %d, len: %d; expected errors to be skipped and b to be evicted", inner.Calls(), c.Len())
+	}
+
+	now = now.Add(time.Minute)
+	process(c, "a")
+
+	if inner.Calls() != 6 {
+		t.Errorf("calls: %d; expected the entry to expire", inner.Calls())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	inner := &testProcessor{errors: []error{nil, deepbooru.ErrTimeout}}
+	observed := 0
+	m := &Metrics{Processor: inner, Observe: func(url string, d time.Duration, err error) { observed++ }}
+
+	process(m, "a")
+	process(m, "b")
+
+	stats := m.Stats()
+
+	if stats.Calls != 2 || stats.Errors != 1 || observed != 2 || stats.Slowest > stats.Total {
+		t.Errorf("stats: %+v, observed: %d", stats, observed)
+	}
+}
+
+func TestConfigBuild(t *testing.T) {
+	inner := &testProcessor{}
+	p := Config{Metrics: true, CacheSize: 10, BreakerThreshold: 2, Retries: 1}.Build(inner)
+
+	m, ok := p.(*Metrics)
+
+	if !ok {
+		t.Fatalf("outermost: %T; expected: *Metrics", p)
+	}
+
+	c, ok := m.Processor.(*Cache)
+
+	if !ok {
+		t.Fatalf("%T; expected: *Cache", m.Processor)
+	}
+
+	b, ok := c.Processor.(*CircuitBreaker)
+
+	if !ok {
+		t.Fatalf("%T; expected: *CircuitBreaker", c.Processor)
+	}
+
+	r, ok := b.Processor.(*Retry)
+
+	if !ok || r.Processor != inner || r.Attempts != 2 {
+		t.Fatalf("%T; expected: *Retry around the processor", b.Processor)
+	}
+
+	if p := (Config{}).Build(inner); p != inner {
+		t.Errorf("empty config: %T; expected the processor itself", p)
+	}
+}
+
+func TestCircuitBreakerFailures(t *testing.T) {
+	cases := []struct {
+		err     error
+		failure bool
+	}{
+		{nil, false},
+		{errors.New("failed"), true},
+		{deepbooru.ErrUnavailable, true},
+		{deepbooru.ErrTerminated, true},
+		{&deepbooru.TerminatedError{Output: []string{"crash"}}, true},
+		{deepbooru.ErrTimeout, false},
+		{deepbooru.ErrCancelled, false},
+		{deepbooru.ErrInvalid, false},
+		{deepbooru.ErrNotFound, false},
+	}
+
+	for _, c := range cases {
+		if failure(c.err) != c.failure {
+			t.Errorf("failure(%v): %v; expected: %v", c.err, !c.failure, c.failure)
+		}
+	}
+}
+
+func TestCircuitBreakerNilGlobal(t *testing.T) {
+	inner := &testProcessor{errors: []error{deepbooru.ErrTerminated}}
+	b := &CircuitBreaker{Processor: inner, Threshold: 1, Cooldown: time.Minute}
+
+	if _, err := b.Process(nil, context.Background(), 0, "a"); err != deepbooru.ErrTerminated {
+		t.Errorf("err: %v; expected: ErrTerminated", err)
+	}
+
+	if !b.IsOpen() {
+		t.Errorf("expected a termination to open the breaker")
+	}
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"deepbooru"
+)
+
+const DefaultRetryBackoff = 100 * time.Millisecond
+
+var DefaultRetryErrors = []error{deepbooru.ErrTerminated, deepbooru.ErrTimeout}
+
+type Retry struct {
+	deepbooru.Processor
+
+	Attempts int
+	Backoff  time.Duration
+	Errors   []error
+}
+
+func (r *Retry) Process(global, local context.Context, timeout time.Duration, url string) ([]deepbooru.Tag, error) {
+	backoff := r.Backoff
+
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+
+	var deadline time.Time
+
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for attempt := 1; ; attempt++ {
+		remaining := timeout
+
+		if timeout > 0 {
+			remaining = time.Until(deadline)
+		}
+
+		tags, err := r.Processor.Process(global, local, remaining, url)
+
+		if err == nil || attempt >= r.Attempts || !r.transient(err) {
+			return tags, err
+		}
+
+		if timeout > 0 && time.Until(deadline) <= backoff {
+			return tags, err
+		}
+
+		log.Printf("Retrying %.64s after a transient error (attempt %d of %d): %s", url, attempt+1, r.Attempts, err)
+
+		timer := time.NewTimer(backoff)
+
+		select {
+		case <-global.Done():
+			timer.Stop()
+
+			return nil, deepbooru.ErrTerminated
+		case <-local.Done():
+			timer.Stop()
+
+			return nil, deepbooru.ErrCancelled
+		case <-timer.C:
+		}
+
+		backoff *= 2
+	}
+}
+
+func (r *Retry) transient(err error) bool {
+	retryable := r.Errors
+
+	if retryable == nil {
+		retryable = DefaultRetryErrors
+	}
+
+	for _, target := range retryable {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,71 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"deepbooru"
+)
+
+type Data struct{}
+
+func (Data) Resolve(ctx context.Context, rawurl string) (io.ReadCloser, error) {
+	_, data, err := ParseDataURL(rawurl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func ParseDataURL(rawurl string) (mediatype string, data []byte, err error) {
+	if Scheme(rawurl) != "data" {
+		return "", nil, deepbooru.ErrInvalid
+	}
+
+	i := strings.IndexByte(rawurl, ',')
+
+	if i < 0 {
+		return "", nil, deepbooru.ErrInvalid
+	}
+
+	header, payload := rawurl[len("data:"):i], rawurl[i+1:]
+	isBase64 := false
+
+	if strings.HasSuffix(header, ";base64") {
+		header = header[:len(header)-len(";base64")]
+		isBase64 = true
+	}
+
+	if header == "" {
+		header = "text/plain;charset=US-ASCII"
+	}
+
+	if isBase64 {
+		data, err = base64.StdEncoding.DecodeString(payload)
+
+		if err != nil {
+			data, err = base64.RawStdEncoding.DecodeString(payload)
+		}
+	} else {
+		var s string
+		s, err = url.PathUnescape(payload)
+		data = []byte(s)
+	}
+
+	if err != nil {
+		return "", nil, deepbooru.ErrInvalid
+	}
+
+	return header, data, nil
+}
+
+func DataURL(mediatype string, data []byte) string {
+	return "data:" + mediatype + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
@@ -0,0 +1,92 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"deepbooru"
+)
+
+var ErrForbidden = fmt.Errorf("%w: forbidden", deepbooru.ErrInvalid)
+
+type File struct {
+	Roots []string
+}
+
+func (f *File) Resolve(ctx context.Context, rawurl string) (io.ReadCloser, error) {
+	u, err := parse(rawurl, "file")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, deepbooru.ErrInvalid
+	}
+
+	path, err := f.allowed(u.Path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return nil, deepbooru.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	if !stat.Mode().IsRegular() {
+		file.Close()
+
+		return nil, deepbooru.ErrInvalid
+	}
+
+	return file, nil
+}
+
+func (f *File) allowed(path string) (string, error) {
+	if path == "" || !filepath.IsAbs(path) {
+		return "", deepbooru.ErrInvalid
+	}
+
+	path, err := filepath.EvalSymlinks(filepath.Clean(path))
+
+	if os.IsNotExist(err) {
+		return "", deepbooru.ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	for _, root := range f.Roots {
+		root, err = filepath.EvalSymlinks(root)
+
+		if err != nil {
+			continue
+		}
+
+		rel, err := filepath.Rel(root, path)
+
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+
+		return path, nil
+	}
+
+	return "", ErrForbidden
+}
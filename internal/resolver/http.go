@@ -0,0 +1,51 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"deepbooru"
+)
+
+type HTTP struct {
+	Client *http.Client
+}
+
+func (h *HTTP) Resolve(ctx context.Context, rawurl string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawurl, nil)
+
+	if err != nil {
+		return nil, deepbooru.ErrInvalid
+	}
+
+	return do(h.Client, req)
+}
+
+func do(client *http.Client, req *http.Request) (io.ReadCloser, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == 200:
+		return resp.Body, nil
+	case resp.StatusCode == 404:
+		err = deepbooru.ErrNotFound
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		err = deepbooru.ErrInvalid
+	default:
+		err = fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	resp.Body.Close()
+
+	return nil, err
+}
@@ -0,0 +1,95 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"deepbooru"
+)
+
+var ErrUnsupportedScheme = fmt.Errorf("%w: unsupported scheme", deepbooru.ErrInvalid)
+
+type Resolver interface {
+	Resolve(ctx context.Context, url string) (io.ReadCloser, error)
+}
+
+type ResolverFunc func(ctx context.Context, url string) (io.ReadCloser, error)
+
+func (f ResolverFunc) Resolve(ctx context.Context, url string) (io.ReadCloser, error) {
+	return f(ctx, url)
+}
+
+type Mux map[string]Resolver
+
+func (m Mux) Resolve(ctx context.Context, rawurl string) (io.ReadCloser, error) {
+	r, ok := m[Scheme(rawurl)]
+
+	if !ok {
+		return nil, ErrUnsupportedScheme
+	}
+
+	return r.Resolve(ctx, rawurl)
+}
+
+func (m Mux) Supports(rawurl string) bool {
+	_, ok := m[Scheme(rawurl)]
+
+	return ok
+}
+
+func Scheme(rawurl string) string {
+	i := strings.IndexByte(rawurl, ':')
+
+	if i <= 0 {
+		return ""
+	}
+
+	return strings.ToLower(rawurl[:i])
+}
+
+type Config struct {
+	FileRoots []string
+
+	S3Endpoint        string
+	S3Region          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	S3SessionToken    string
+}
+
+func New(cfg Config) Mux {
+	m := Mux{
+		"http":  &HTTP{},
+		"https": &HTTP{},
+		"data":  Data{},
+	}
+
+	if len(cfg.FileRoots) > 0 {
+		m["file"] = &File{Roots: cfg.FileRoots}
+	}
+
+	if cfg.S3Endpoint != "" {
+		m["s3"] = &S3{
+			Endpoint:        cfg.S3Endpoint,
+			Region:          cfg.S3Region,
+			AccessKeyID:     cfg.S3AccessKeyID,
+			SecretAccessKey: cfg.S3SecretAccessKey,
+			SessionToken:    cfg.S3SessionToken,
+		}
+	}
+
+	return m
+}
+
+func parse(rawurl, scheme string) (*url.URL, error) {
+	u, err := url.Parse(rawurl)
+
+	if err != nil || !strings.EqualFold(u.Scheme, scheme) {
+		return nil, deepbooru.ErrInvalid
+	}
+
+	return u, nil
+}
@@ -0,0 +1,146 @@
+package resolver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"deepbooru"
+)
+
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type S3 struct {
+	Endpoint        string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	Client *http.Client
+
+	now func() time.Time
+}
+
+func (s *S3) Resolve(ctx context.Context, rawurl string) (io.ReadCloser, error) {
+	u, err := parse(rawurl, "s3")
+
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+
+	if bucket == "" || key == "" {
+		return nil, deepbooru.ErrInvalid
+	}
+
+	endpoint := strings.TrimRight(s.Endpoint, "/")
+	path := "/" + encodePath(bucket) + "/" + encodePath(key)
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+path, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now
+
+	if s.now != nil {
+		now = s.now
+	}
+
+	if s.AccessKeyID != "" {
+		s.sign(req, now())
+	}
+
+	return do(s.Client, req)
+}
+
+func (s *S3) sign(req *http.Request, t time.Time) {
+	t = t.UTC()
+	timestamp := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	region := s.Region
+
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	req.Header.Set("X-Amz-Date", timestamp)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var canonical strings.Builder
+
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(req.URL.EscapedPath() + "\n")
+	canonical.WriteString(req.URL.RawQuery + "\n")
+
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+	scope := date + "/" + region + "/s3/aws4_request"
+
+	canonical.WriteString("\n" + signedHeaders + "\n" + emptySHA256)
+
+	digest := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+func encodePath(path string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+
+	return b.String()
+}
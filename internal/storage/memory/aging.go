@@ -0,0 +1,55 @@
+package memory_storage
+
+import (
+	"sort"
+	"time"
+
+	"deepbooru"
+)
+
+const DefaultAgingCap = 10
+
+type queued struct {
+	id       int64
+	priority int
+}
+
+func (s *Storage) priority(info *deepbooru.Info, now time.Time) int {
+	if s.AgingInterval <= 0 {
+		return info.Priority
+	}
+
+	limit := s.AgingCap
+
+	if limit <= 0 {
+		limit = DefaultAgingCap
+	}
+
+	boost := int(now.Sub(info.Submitted) / s.AgingInterval)
+
+	if boost < 0 {
+		boost = 0
+	}
+
+	if boost > limit {
+		boost = limit
+	}
+
+	return info.Priority + boost
+}
+
+func (s *Storage) ordered(now time.Time) []queued {
+	order := make([]queued, len(s.pending))
+
+	for i, id := range s.pending {
+		order[i] = queued{id, s.priority(s.jobs[id], now)}
+	}
+
+	if s.AgingInterval > 0 {
+		sort.SliceStable(order, func(i, j int) bool {
+			return order[i].priority > order[j].priority
+		})
+	}
+
+	return order
+}
@@ -0,0 +1,185 @@
+package memory_storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"deepbooru"
+)
+
+var ErrInvalidWeights = errors.New("invalid weights")
+
+func ParseWeights(s string) (map[deepbooru.AccessLevel]int, error) {
+	weights := make(map[deepbooru.AccessLevel]int)
+
+	if s == "" {
+		return weights, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidWeights, pair)
+		}
+
+		level, err := deepbooru.ParseAccessLevel(strings.TrimSpace(parts[0]))
+
+		if err != nil {
+			return nil, err
+		}
+
+		weight, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidWeights, pair)
+		}
+
+		weights[level] = weight
+	}
+
+	return weights, nil
+}
+
+type fairState struct {
+	ring    []string
+	deficit map[string]int
+	turn    bool
+}
+
+func (f *fairState) copy() fairState {
+	c := fairState{
+		ring:    append([]string(nil), f.ring...),
+		deficit: make(map[string]int, len(f.deficit)),
+		turn:    f.turn,
+	}
+
+	for submitter, deficit := range f.deficit {
+		c.deficit[submitter] = deficit
+	}
+
+	return c
+}
+
+func (f *fairState) rotate() {
+	f.ring = append(f.ring[1:], f.ring[0])
+	f.turn = false
+}
+
+func (f *fairState) prune(submitters map[string]bool) {
+	ring := f.ring[:0]
+
+	for i, submitter := range f.ring {
+		if submitters[submitter] {
+			ring = append(ring, submitter)
+		} else {
+			delete(f.deficit, submitter)
+
+			if i == 0 {
+				f.turn = false
+			}
+		}
+	}
+
+	f.ring = ring
+}
+
+func (s *Storage) weight(info *deepbooru.Info) int {
+	if weight, ok := s.Weights[info.Level]; ok && weight > 0 {
+		return weight
+	}
+
+	return 1
+}
+
+func (s *Storage) schedule(n int, now time.Time, servable func(*deepbooru.Info) bool) ([]int64, fairState) {
+	var scheduled []int64
+	order := s.ordered(now)
+
+	if !s.Fair {
+		for _, job := range order {
+			if n >= 0 && len(scheduled) >= n {
+				break
+			}
+
+			if servable(s.jobs[job.id]) {
+				scheduled = append(scheduled, job.id)
+			}
+		}
+
+		return scheduled, s.fair
+	}
+
+	state := s.fair.copy()
+
+	for start := 0; start < len(order) && n != len(scheduled); {
+		priority := order[start].priority
+		queues := make(map[string][]int64)
+		left := 0
+		end := start
+
+		for ; end < len(order) && order[end].priority == priority; end++ {
+			info := s.jobs[order[end].id]
+
+			if !servable(info) {
+				continue
+			}
+
+			if _, ok := queues[info.Submitter]; !ok && !contains(state.ring, info.Submitter) {
+				state.ring = append(state.ring, info.Submitter)
+			}
+
+			queues[info.Submitter] = append(queues[info.Submitter], info.ID)
+			left++
+		}
+
+		start = end
+
+		for left > 0 && n != len(scheduled) {
+			submitter := state.ring[0]
+			queue := queues[submitter]
+
+			if len(queue) == 0 {
+				state.rotate()
+
+				continue
+			}
+
+			if !state.turn {
+				state.deficit[submitter] += s.weight(s.jobs[queue[0]])
+				state.turn = true
+			}
+
+			for len(queue) > 0 && state.deficit[submitter] >= 1 && n != len(scheduled) {
+				scheduled = append(scheduled, queue[0])
+				queue = queue[1:]
+				state.deficit[submitter]--
+				left--
+			}
+
+			queues[submitter] = queue
+
+			if len(queue) == 0 {
+				state.deficit[submitter] = 0
+				state.rotate()
+			} else if state.deficit[submitter] < 1 {
+				state.rotate()
+			}
+		}
+	}
+
+	return scheduled, state
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
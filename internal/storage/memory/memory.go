@@ -0,0 +1,346 @@
+package memory_storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"deepbooru"
+)
+
+type Storage struct {
+	sync.Mutex
+
+	Fair    bool
+	Weights map[deepbooru.AccessLevel]int
+
+	AgingInterval time.Duration
+	AgingCap      int
+
+	jobs    map[int64]*deepbooru.Info
+	pending []int64
+	lastID  int64
+	fair    fairState
+	now     func() time.Time
+}
+
+func New() *Storage {
+	return &Storage{
+		jobs: make(map[int64]*deepbooru.Info),
+		fair: fairState{deficit: make(map[string]int)},
+		now:  time.Now,
+	}
+}
+
+func copyInfo(info *deepbooru.Info) deepbooru.Info {
+	c := *info
+	c.Tags = append([]deepbooru.Tag(nil), info.Tags...)
+	c.Requires = append([]string(nil), info.Requires...)
+
+	return c
+}
+
+func finished(info *deepbooru.Info) bool {
+	return info.Status == deepbooru.Done || info.Status == deepbooru.Failed
+}
+
+func (s *Storage) enqueue(id int64) {
+	s.pending = append(s.pending, id)
+
+	sort.SliceStable(s.pending, func(i, j int) bool {
+		a, b := s.jobs[s.pending[i]], s.jobs[s.pending[j]]
+
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+
+		return a.ID < b.ID
+	})
+}
+
+func (s *Storage) dequeue(id int64) {
+	for i := range s.pending {
+		if s.pending[i] == id {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+
+			return
+		}
+	}
+}
+
+func (s *Storage) AbortStalled(timeout time.Duration) ([]deepbooru.Info, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var aborted []deepbooru.Info
+	deadline := s.now().Add(-timeout)
+
+	for _, info := range s.jobs {
+		if info.Status != deepbooru.Processing || info.LastActivity.After(deadline) {
+			continue
+		}
+
+		info.Status = deepbooru.Failed
+		info.ErrorCode = deepbooru.Timeout
+		info.ErrorReason = "timeout"
+		info.LastActivity = s.now()
+		aborted = append(aborted, copyInfo(info))
+	}
+
+	sort.Slice(aborted, func(i, j int) bool { return aborted[i].ID < aborted[j].ID })
+
+	return aborted, nil
+}
+
+func (s *Storage) ListActive() ([]deepbooru.Info, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var active []deepbooru.Info
+
+	for _, info := range s.jobs {
+		if info.Status == deepbooru.Pending || info.Status == deepbooru.Processing {
+			active = append(active, copyInfo(info))
+		}
+	}
+
+	sort.Slice(active, func(i, j int) bool { return active[i].ID < active[j].ID })
+
+	return active, nil
+}
+
+func (s *Storage) QueueSize() (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.pending), nil
+}
+
+func (s *Storage) Position(id int64) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	scheduled, _ := s.schedule(-1, s.now(), func(*deepbooru.Info) bool { return true })
+
+	for i := range scheduled {
+		if scheduled[i] == id {
+			return i, nil
+		}
+	}
+
+	return 0, deepbooru.ErrNotFound
+}
+
+func (s *Storage) Push(url string, priority int, requires []string, submitter deepbooru.Auth) (*deepbooru.Info, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastID++
+	info := &deepbooru.Info{
+		ID:           s.lastID,
+		URL:          url,
+		Status:       deepbooru.Pending,
+		Priority:     priority,
+		Requires:     append([]string(nil), requires...),
+		Submitter:    submitter.ID,
+		Level:        submitter.Level,
+		Submitted:    s.now(),
+		LastActivity: s.now(),
+	}
+	s.jobs[info.ID] = info
+	s.enqueue(info.ID)
+
+	c := copyInfo(info)
+
+	return &c, nil
+}
+
+func (s *Storage) Pop(n int, capabilities []string) ([]deepbooru.Info, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if n <= 0 {
+		return nil, nil
+	}
+
+	scheduled, state := s.schedule(n, s.now(), func(info *deepbooru.Info) bool {
+		return info.ServableBy(capabilities)
+	})
+
+	popped := make([]deepbooru.Info, 0, len(scheduled))
+
+	for _, id := range scheduled {
+		info := s.jobs[id]
+		info.Status = deepbooru.Processing
+		info.Attempt++
+		info.LastActivity = s.now()
+		popped = append(popped, copyInfo(info))
+		s.dequeue(id)
+	}
+
+	submitters := make(map[string]bool)
+
+	for _, id := range s.pending {
+		submitters[s.jobs[id].Submitter] = true
+	}
+
+	state.prune(submitters)
+	s.fair = state
+
+	return popped, nil
+}
+
+func (s *Storage) Reset(leases []deepbooru.Lease) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, l := range leases {
+		info, ok := s.jobs[l.ID]
+
+		if !ok || info.Status != deepbooru.Processing || lease(info, l.Attempt) != nil {
+			continue
+		}
+
+		info.Status = deepbooru.Pending
+		info.LastActivity = s.now()
+		s.enqueue(l.ID)
+	}
+
+	return nil
+}
+
+func (s *Storage) Get(id int64) (*deepbooru.Info, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	info, ok := s.jobs[id]
+
+	if !ok {
+		return nil, deepbooru.ErrNotFound
+	}
+
+	c := copyInfo(info)
+
+	return &c, nil
+}
+
+func lease(info *deepbooru.Info, attempt int64) error {
+	if attempt != info.Attempt || info.Status == deepbooru.Pending {
+		return deepbooru.ErrStale
+	}
+
+	return nil
+}
+
+func (s *Storage) Beat(id, attempt int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	info, ok := s.jobs[id]
+
+	if !ok {
+		return deepbooru.ErrNotFound
+	}
+
+	err := lease(info, attempt)
+
+	if err != nil {
+		return err
+	}
+
+	if info.Status == deepbooru.Processing {
+		info.LastActivity = s.now()
+	}
+
+	return nil
+}
+
+func (s *Storage) Done(id, attempt int64, tags []deepbooru.Tag, failed []string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	info, ok := s.jobs[id]
+
+	if !ok {
+		return deepbooru.ErrNotFound
+	}
+
+	err := lease(info, attempt)
+
+	if err != nil {
+		return err
+	}
+
+	if finished(info) {
+		return nil
+	}
+
+	if info.Status == deepbooru.Pending {
+		s.dequeue(id)
+	}
+
+	info.Status = deepbooru.Done
+	info.Tags = append([]deepbooru.Tag(nil), tags...)
+	info.Failed = append([]string(nil), failed...)
+	info.LastActivity = s.now()
+
+	return nil
+}
+
+func (s *Storage) Error(id, attempt int64, code deepbooru.ErrorCode, reason string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	info, ok := s.jobs[id]
+
+	if !ok {
+		return deepbooru.ErrNotFound
+	}
+
+	err := lease(info, attempt)
+
+	if err != nil {
+		return err
+	}
+
+	if finished(info) {
+		return nil
+	}
+
+	if info.Status == deepbooru.Pending {
+		s.dequeue(id)
+	}
+
+	info.Status = deepbooru.Failed
+	info.ErrorCode = code
+	info.ErrorReason = reason
+	info.LastActivity = s.now()
+
+	return nil
+}
+
+func (s *Storage) Cancel(id int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	info, ok := s.jobs[id]
+
+	if !ok {
+		return deepbooru.ErrNotFound
+	}
+
+	if finished(info) {
+		return nil
+	}
+
+	if info.Status == deepbooru.Pending {
+		s.dequeue(id)
+	}
+
+	info.Status = deepbooru.Failed
+	info.ErrorCode = deepbooru.Canceled
+	info.ErrorReason = ""
+	info.LastActivity = s.now()
+
+	return nil
+}
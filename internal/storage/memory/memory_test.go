@@ -0,0 +1,401 @@
+package memory_storage
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"deepbooru"
+)
+
+func ids(infos []deepbooru.Info) []int64 {
+	result := make([]int64, len(infos))
+
+	for i := range infos {
+		result[i] = infos[i].ID
+	}
+
+	return result
+}
+
+func push(t *testing.T, s *Storage, priority int, requires ...string) int64 {
+	info, err := s.Push("http://example.com", priority, requires, deepbooru.Anonymous)
+
+	if err != nil {
+		t.Fatalf("push: %s", err)
+	}
+
+	return info.ID
+}
+
+func TestPopPriority(t *testing.T) {
+	s := New()
+	low := push(t, s, 0)
+	high := push(t, s, 10)
+	low2 := push(t, s, 0)
+
+	if position, err := s.Position(low2); err != nil || position != 2 {
+		t.Errorf("position: %d, %v; expected: 2", position, err)
+	}
+
+	popped, _ := s.Pop(2, nil)
+
+	if !reflect.DeepEqual(ids(popped), []int64{high, low}) {
+		t.Errorf("popped: %v; expected: %v", ids(popped), []int64{high, low})
+	}
+
+	if size, _ := s.QueueSize(); size != 1 {
+		t.Errorf("queue size: %d; expected: 1", size)
+	}
+
+	if err := s.Reset([]deepbooru.Lease{{ID: high, Attempt: popped[0].Attempt}}); err != nil {
+		t.Fatalf("reset: %s", err)
+	}
+
+	if position, _ := s.Position(high); position != 0 {
+		t.Errorf("position: %d; expected a reset job to keep its priority", position)
+	}
+}
+
+func TestPopCapabilities(t *testing.T) {
+	s := New()
+	anyModel := push(t, s, 0)
+	wd14 := push(t, s, 5, "model=wd14")
+	nsfw := push(t, s, 5, "model=wd14", "nsfw-only")
+
+	popped, _ := s.Pop(10, []string{"model=deepdanbooru"})
+
+	if !reflect.DeepEqual(ids(popped), []int64{anyModel}) {
+		t.Errorf("popped: %v; expected: %v", ids(popped), []int64{anyModel})
+	}
+
+	popped, _ = s.Pop(10, []string{"model=wd14"})
+
+	if !reflect.DeepEqual(ids(popped), []int64{wd14}) {
+		t.Errorf("popped: %v; expected: %v", ids(popped), []int64{wd14})
+	}
+
+	if position, err := s.Position(nsfw); err != nil || position != 0 {
+		t.Errorf("position: %d, %v; expected the unservable job to stay queued", position, err)
+	}
+}
+
+func TestAbortStalled(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := New()
+	s.now = func() time.Time { return now }
+	stalled := push(t, s, 0)
+	alive := push(t, s, 0)
+	popped, _ := s.Pop(2, nil)
+
+	now = now.Add(time.Minute)
+	s.Beat(alive, popped[1].Attempt)
+	now = now.Add(time.Second)
+
+	aborted, _ := s.AbortStalled(30 * time.Second)
+
+	if !reflect.DeepEqual(ids(aborted), []int64{stalled}) || aborted[0].ErrorCode != deepbooru.Timeout {
+		t.Errorf("aborted: %+v; expected job %d to time out", aborted, stalled)
+	}
+
+	active, _ := s.ListActive()
+
+	if !reflect.DeepEqual(ids(active), []int64{alive}) {
+		t.Errorf("active: %v; expected: %v", ids(active), []int64{alive})
+	}
+}
+
+func TestFinish(t *testing.T) {
+	s := New()
+	done := push(t, s, 0)
+	cancelled := push(t, s, 0)
+
+	popped, _ := s.Pop(1, nil)
+
+	if err := s.Done(done, popped[0].Attempt, []deepbooru.Tag{{Name: "cat", Score: 1}}, nil); err != nil {
+		t.Fatalf("done: %s", err)
+	}
+
+	if err := s.Cancel(cancelled); err != nil {
+		t.Fatalf("cancel: %s", err)
+	}
+
+	s.Cancel(done)
+
+	info, _ := s.Get(done)
+
+	if info.Status != deepbooru.Done || len(info.Tags) != 1 {
+		t.Errorf("info: %+v; expected a finished job to stay done", info)
+	}
+
+	if size, _ := s.QueueSize(); size != 0 {
+		t.Errorf("queue size: %d; expected a cancelled job to leave the queue", size)
+	}
+
+	if _, err := s.Get(99); err != deepbooru.ErrNotFound {
+		t.Errorf("err: %v; expected: ErrNotFound", err)
+	}
+}
+
+func TestStaleAttempt(t *testing.T) {
+	s := New()
+	id := push(t, s, 0)
+
+	first, _ := s.Pop(1, nil)
+	s.Reset([]deepbooru.Lease{{ID: id, Attempt: first[0].Attempt}})
+
+	if err := s.Done(id, first[0].Attempt, nil, nil); err != deepbooru.ErrStale {
+		t.Errorf("err: %v; expected a reset attempt to be stale", err)
+	}
+
+	second, _ := s.Pop(1, nil)
+
+	if second[0].Attempt == first[0].Attempt {
+		t.Fatalf("attempt: %d; expected a new attempt", second[0].Attempt)
+	}
+
+	if err := s.Beat(id, first[0].Attempt); err != deepbooru.ErrStale {
+		t.Errorf("beat: %v; expected: ErrStale", err)
+	}
+
+	if err := s.Error(id, first[0].Attempt, deepbooru.Timeout, "timeout"); err != deepbooru.ErrStale {
+		t.Errorf("error: %v; expected: ErrStale", err)
+	}
+
+	if err := s.Error(id, 0, deepbooru.Timeout, "timeout"); err != deepbooru.ErrStale {
+		t.Errorf("error: %v; expected a missing attempt to be stale", err)
+	}
+
+	s.Reset([]deepbooru.Lease{{ID: id, Attempt: first[0].Attempt}})
+
+	if info, _ := s.Get(id); info.Status != deepbooru.Processing {
+		t.Errorf("status: %v; expected a stale deschedule to leave the new attempt alone", info.Status)
+	}
+
+	if err := s.Done(id, second[0].Attempt, []deepbooru.Tag{{Name: "cat", Score: 1}}, nil); err != nil {
+		t.Fatalf("done: %s", err)
+	}
+
+	if err := s.Done(id, first[0].Attempt, nil, nil); err != deepbooru.ErrStale {
+		t.Errorf("err: %v; expected a finished job to reject the old attempt", err)
+	}
+
+	info, _ := s.Get(id)
+
+	if info.Status != deepbooru.Done || len(info.Tags) != 1 {
+		t.Errorf("info: %+v; expected the second attempt to win", info)
+	}
+}
+
+func TestPopFair(t *testing.T) {
+	s := New()
+	s.Fair = true
+	s.Weights = map[deepbooru.AccessLevel]int{deepbooru.LevelMod: 2}
+
+	a := deepbooru.Auth{ID: "a", Level: deepbooru.LevelUser}
+	b := deepbooru.Auth{ID: "b", Level: deepbooru.LevelUser}
+	m := deepbooru.Auth{ID: "m", Level: deepbooru.LevelMod}
+	submit := func(priority int, auth deepbooru.Auth) int64 {
+		info, err := s.Push("http://example.com", priority, nil, auth)
+
+		if err != nil {
+			t.Fatalf("push: %s", err)
+		}
+
+		return info.ID
+	}
+
+	a1, a2, a3, a4 := submit(0, a), submit(0, a), submit(0, a), submit(0, a)
+	b1, b2 := submit(0, b), submit(0, b)
+	m1, m2, m3 := submit(0, m), submit(0, m), submit(0, m)
+	a5 := submit(10, a)
+
+	expected := []int64{a5, a1, b1, m1, m2, a2, b2, m3, a3, a4}
+
+	if position, err := s.Position(a4); err != nil || position != 9 {
+		t.Errorf("position: %d, %v; expected: 9", position, err)
+	}
+
+	if position, _ := s.Position(b1); position != 2 {
+		t.Errorf("position: %d; expected: 2", position)
+	}
+
+	var popped []int64
+
+	for _, n := range []int{4, 3, 3} {
+		infos, _ := s.Pop(n, nil)
+		popped = append(popped, ids(infos)...)
+
+		if len(popped) < len(expected) {
+			next := expected[len(popped)]
+
+			if position, _ := s.Position(next); position != 0 {
+				t.Errorf("position of %d: %d; expected it to be popped next", next, position)
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(popped, expected) {
+		t.Errorf("popped: %v; expected: %v", popped, expected)
+	}
+}
+
+func TestParseWeights(t *testing.T) {
+	weights, err := ParseWeights("user=2, mod=4")
+	expected := map[deepbooru.AccessLevel]int{deepbooru.LevelUser: 2, deepbooru.LevelMod: 4}
+
+	if err != nil || !reflect.DeepEqual(weights, expected) {
+		t.Errorf("weights: %v, %v; expected: %v", weights, err, expected)
+	}
+
+	for _, s := range []string{"user", "user=0", "root=1"} {
+		if _, err := ParseWeights(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestPopAging(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := New()
+	s.AgingInterval = time.Minute
+	s.AgingCap = 5
+	s.now = func() time.Time { return now }
+
+	low := push(t, s, 0)
+	now = now.Add(3 * time.Minute)
+	high := push(t, s, 2)
+
+	if position, _ := s.Position(low); position != 0 {
+		t.Errorf("position: %d; expected the aged job to go first", position)
+	}
+
+	popped, _ := s.Pop(1, nil)
+
+	if !reflect.DeepEqual(ids(popped), []int64{low}) {
+		t.Errorf("popped: %v; expected: %v", ids(popped), []int64{low})
+	}
+
+	now = now.Add(time.Hour)
+	urgent := push(t, s, 8)
+
+	if position, _ := s.Position(high); position != 1 {
+		t.Errorf("position: %d; expected the aging to be capped", position)
+	}
+
+	popped, _ = s.Pop(2, nil)
+
+	if !reflect.DeepEqual(ids(popped), []int64{urgent, high}) {
+		t.Errorf("popped: %v; expected: %v", ids(popped), []int64{urgent, high})
+	}
+}
+
+func TestResetKeepsAge(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := New()
+	s.AgingInterval = time.Minute
+	s.now = func() time.Time { return now }
+
+	old := push(t, s, 0)
+	now = now.Add(3 * time.Minute)
+	popped, _ := s.Pop(1, nil)
+	s.Reset([]deepbooru.Lease{{ID: old, Attempt: popped[0].Attempt}})
+	fresh := push(t, s, 2)
+
+	if position, _ := s.Position(old); position != 0 {
+		t.Errorf("position: %d; expected the reset job to keep its age", position)
+	}
+
+	popped, _ = s.Pop(2, nil)
+
+	if !reflect.DeepEqual(ids(popped), []int64{old, fresh}) {
+		t.Errorf("popped: %v; expected: %v", ids(popped), []int64{old, fresh})
+	}
+}
+
+type testModel struct {
+	tags []deepbooru.Tag
+	err  error
+}
+
+func (m *testModel) Process(global, local context.Context, timeout time.Duration, url string) ([]deepbooru.Tag, error) {
+	return m.tags, m.err
+}
+
+func (m *testModel) Capacity() int {
+	return 1
+}
+
+func (m *testModel) IsReady() bool {
+	return true
+}
+
+type testLoopBus struct {
+	deepbooru.ManagerBus
+
+	worker *deepbooru.Worker
+}
+
+func (b *testLoopBus) Schedule(node string, tasks []deepbooru.Info) error {
+	return b.worker.OnSchedule(node, tasks)
+}
+
+type testLoopBusFactory struct {
+	bus *testLoopBus
+}
+
+func (f *testLoopBusFactory) Publish() deepbooru.Bus {
+	return f.bus
+}
+
+func (f *testLoopBusFactory) SubscribeAll(bus deepbooru.Bus, consume bool, types ...string) (deepbooru.Terminator, error) {
+	return func() {}, nil
+}
+
+func (f *testLoopBusFactory) SubscribeOne(bus deepbooru.Bus, consume bool, id int64, types ...string) (deepbooru.Terminator, error) {
+	return func() {}, nil
+}
+
+func TestPartialResult(t *testing.T) {
+	s := New()
+	bus := &testLoopBus{}
+	bf := &testLoopBusFactory{bus}
+	bus.Manager = deepbooru.NewManager(nil, bf, s)
+	bus.worker = deepbooru.NewWorker(bf)
+	bus.worker.Name = "node"
+	bus.worker.TickInterval = 10 * time.Millisecond
+	bus.worker.Processor = &deepbooru.EnsembleProcessor{
+		Members: []deepbooru.EnsembleMember{
+			{Processor: &testModel{tags: []deepbooru.Tag{{Name: "cat", Score: 1}}}, Name: "good", Weight: 1},
+			{Processor: &testModel{err: errors.New("boom")}, Name: "broken", Weight: 1},
+		},
+	}
+
+	id := push(t, s, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+
+	go func() {
+		bus.worker.Run(ctx)
+		close(stopped)
+	}()
+
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	info, _ := s.Get(id)
+
+	for info.Status != deepbooru.Done && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		info, _ = s.Get(id)
+	}
+
+	if !info.Partial() || !reflect.DeepEqual(info.Failed, []string{"broken"}) || len(info.Tags) != 1 {
+		t.Errorf("info: %+v; expected a partial result without the broken model", info)
+	}
+}
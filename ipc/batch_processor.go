@@ -0,0 +1,228 @@
+package deepbooru_ipc
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"deepbooru"
+)
+
+const DefaultBatchWindow = 20 * time.Millisecond
+
+type BatchProcessor struct {
+	sync.Mutex
+
+	Processor *Processor
+	MaxItems  int
+	Window    time.Duration
+
+	queue []queued
+	timer *time.Timer
+}
+
+type queued struct {
+	m   Message
+	ctx context.Context
+}
+
+func (bp *BatchProcessor) maxItems(hello *Hello) int {
+	if !hello.Multiplexed() || hello.MaxBatch <= 1 {
+		return 1
+	}
+
+	if bp.MaxItems > 0 && bp.MaxItems < hello.MaxBatch {
+		return bp.MaxItems
+	}
+
+	return hello.MaxBatch
+}
+
+func (bp *BatchProcessor) Process(global, local context.Context, timeout time.Duration, url string) ([]deepbooru.Tag, error) {
+	p := bp.Processor
+
+	if !p.Bus.IsReady() {
+		return nil, p.terminated()
+	}
+
+	hello := p.Bus.Hello()
+	maxItems := bp.maxItems(hello)
+
+	if maxItems <= 1 {
+		return p.Process(global, local, timeout, url)
+	}
+
+	p.setBusy(true)
+	defer p.setBusy(false)
+
+	ctx, cancel := deadline(global, local, timeout)
+
+	defer cancel()
+
+	m, cleanup, err := p.message(ctx, hello, url)
+
+	if err != nil && ctx.Err() != nil {
+		return nil, cause(global, local)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer cleanup()
+
+	id, result := p.register()
+	m.ID = id
+
+	defer p.unregister(id)
+
+	log.Printf("Queueing %.64s (id=%d, %s)", url, id, m.Input)
+	bp.enqueue(queued{m, ctx}, maxItems)
+	p.route()
+
+	return p.wait(global, local, ctx, id, result, func() {
+		if !bp.dequeue(id) {
+			p.cancel(global, hello, id)
+		}
+	})
+}
+
+func (bp *BatchProcessor) enqueue(q queued, maxItems int) {
+	bp.Lock()
+
+	bp.queue = append(bp.queue, q)
+
+	if len(bp.queue) < maxItems {
+		if bp.timer == nil {
+			window := bp.Window
+
+			if window <= 0 {
+				window = DefaultBatchWindow
+			}
+
+			bp.timer = time.AfterFunc(window, bp.flush)
+		}
+
+		bp.Unlock()
+
+		return
+	}
+
+	batch := bp.take()
+
+	bp.Unlock()
+
+	bp.send(batch)
+}
+
+func (bp *BatchProcessor) dequeue(id int64) bool {
+	bp.Lock()
+	defer bp.Unlock()
+
+	for i := range bp.queue {
+		if bp.queue[i].m.ID == id {
+			bp.queue = append(bp.queue[:i], bp.queue[i+1:]...)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func (bp *BatchProcessor) take() []queued {
+	batch := bp.queue
+	bp.queue = nil
+
+	if bp.timer != nil {
+		bp.timer.Stop()
+		bp.timer = nil
+	}
+
+	return batch
+}
+
+func (bp *BatchProcessor) flush() {
+	bp.Lock()
+	batch := bp.take()
+	bp.Unlock()
+
+	bp.send(batch)
+}
+
+func (bp *BatchProcessor) send(batch []queued) {
+	if len(batch) == 0 {
+		return
+	}
+
+	m := batch[0].m
+
+	if len(batch) > 1 {
+		log.Printf("Sending batch of %d", len(batch))
+
+		m = Message{Batch: make([]Message, len(batch))}
+
+		for i := range batch {
+			m.Batch[i] = batch[i].m
+		}
+	}
+
+	abandoned, stop := abandoned(batch)
+
+	defer stop()
+
+	bus := bp.Processor.Bus
+
+	select {
+	case bus.In() <- m:
+	case <-bus.Done():
+		log.Printf("Dropping %d queued requests, the model bus is closed", len(batch))
+	case <-abandoned:
+		log.Printf("Dropping %d queued requests, all callers gave up", len(batch))
+	}
+}
+
+func abandoned(batch []queued) (<-chan struct{}, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	remaining := int32(len(batch))
+
+	for i := range batch {
+		go func(done <-chan struct{}) {
+			select {
+			case <-done:
+				if atomic.AddInt32(&remaining, -1) == 0 {
+					cancel()
+				}
+			case <-ctx.Done():
+			}
+		}(batch[i].ctx.Done())
+	}
+
+	return ctx.Done(), cancel
+}
+
+func (bp *BatchProcessor) Capacity() int {
+	p := bp.Processor
+
+	if !p.Bus.IsReady() {
+		return 0
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	hello := p.Bus.Hello()
+	free := hello.MaxConcurrency()*bp.maxItems(hello) - p.busy
+
+	if free < 0 {
+		return 0
+	}
+
+	return free
+}
+
+func (bp *BatchProcessor) IsReady() bool {
+	return bp.Processor.IsReady()
+}
@@ -0,0 +1,213 @@
+package deepbooru_ipc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"deepbooru"
+)
+
+type testBatchResult struct {
+	url  string
+	tags []deepbooru.Tag
+	err  error
+}
+
+func processAsync(bp *BatchProcessor, local context.Context, url string, results chan<- testBatchResult) {
+	go func() {
+		tags, err := bp.Process(context.Background(), local, 0, url)
+		results <- testBatchResult{url, tags, err}
+	}()
+}
+
+func TestBatchProcessorProcess(t *testing.T) {
+	b := testBus{
+		in:    make(chan Message, 4),
+		out:   make(chan Message),
+		hello: &Hello{Version: MultiplexedVersion, MaxBatch: 3},
+	}
+	bp := BatchProcessor{Processor: &Processor{Bus: &b}, Window: time.Minute}
+	results := make(chan testBatchResult, 3)
+	local, cancel := context.WithCancel(context.Background())
+
+	processAsync(&bp, context.Background(), "http://example.com/1.jpg", results)
+	processAsync(&bp, context.Background(), "http://example.com/2.jpg", results)
+	processAsync(&bp, local, "http://example.com/3.jpg", results)
+
+	batch := (<-b.in).Batch
+
+	if len(batch) != 3 {
+		t.Fatalf("batch: %#v; expected 3 items", batch)
+	}
+
+	ids := map[string]int64{}
+
+	for _, m := range batch {
+		ids[m.URL] = m.ID
+	}
+
+	cancel()
+
+	if r := <-results; r.url != "http://example.com/3.jpg" || r.err != deepbooru.ErrCancelled {
+		t.Errorf("result: %#v; expected cancelled 3.jpg", r)
+	}
+
+	if m := <-b.in; !m.Cancel || m.ID != ids["http://example.com/3.jpg"] {
+		t.Errorf("message: %#v; expected cancel of 3.jpg", m)
+	}
+
+	b.out <- Message{Batch: []Message{
+		{ID: ids["http://example.com/1.jpg"], Tags: []deepbooru.Tag{{Name: "one", Score: 1}}},
+		{ID: ids["http://example.com/2.jpg"], Error: "broken image"},
+		{ID: ids["http://example.com/3.jpg"], Error: "cancelled"},
+	}}
+
+	got := map[string]testBatchResult{}
+
+	for i := 0; i < 2; i++ {
+		r := <-results
+		got[r.url] = r
+	}
+
+	if r := got["http://example.com/1.jpg"]; r.err != nil || !reflect.DeepEqual(r.tags, []deepbooru.Tag{{Name: "one", Score: 1}}) {
+		t.Errorf("result: %#v", r)
+	}
+
+	if r := got["http://example.com/2.jpg"]; r.err == nil || r.err.Error() != "broken image" {
+		t.Errorf("result: %#v", r)
+	}
+}
+
+func TestBatchProcessorWindow(t *testing.T) {
+	b := testBus{
+		in:    make(chan Message, 2),
+		out:   make(chan Message),
+		hello: &Hello{Version: MultiplexedVersion, MaxBatch: 8},
+	}
+	bp := BatchProcessor{Processor: &Processor{Bus: &b}, MaxItems: 4, Window: 10 * time.Millisecond}
+	results := make(chan testBatchResult, 2)
+
+	if capacity := bp.Capacity(); capacity != 4 {
+		t.Errorf("capacity: %d; expected: 4", capacity)
+	}
+
+	processAsync(&bp, context.Background(), "http://example.com/1.jpg", results)
+
+	m := <-b.in
+
+	if m.Batch != nil || m.URL != "http://example.com/1.jpg" {
+		t.Errorf("message: %#v; expected single request", m)
+	}
+
+	b.out <- Message{ID: m.ID}
+
+	if r := <-results; r.err != nil {
+		t.Errorf("err: %s", r.err)
+	}
+}
+
+func TestBatchProcessorCancelQueued(t *testing.T) {
+	b := testBus{
+		in:    make(chan Message, 2),
+		out:   make(chan Message),
+		hello: &Hello{Version: MultiplexedVersion, MaxBatch: 8},
+	}
+	bp := BatchProcessor{Processor: &Processor{Bus: &b}, Window: time.Minute}
+	results := make(chan testBatchResult, 1)
+	local, cancel := context.WithCancel(context.Background())
+
+	queued := func() int {
+		bp.Lock()
+		defer bp.Unlock()
+
+		return len(bp.queue)
+	}
+
+	processAsync(&bp, local, "http://example.com/1.jpg", results)
+
+	for queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+
+	if r := <-results; r.err != deepbooru.ErrCancelled {
+		t.Errorf("err: %v; expected: deepbooru.ErrCancelled", r.err)
+	}
+
+	if len(b.in) != 0 || queued() != 0 {
+		t.Errorf("cancelled request was not removed from the queue")
+	}
+}
+
+func TestBatchProcessorLegacy(t *testing.T) {
+	b := testBus{
+		in:    make(chan Message, 1),
+		out:   make(chan Message),
+		hello: &Hello{Version: 1, MaxBatch: 8},
+	}
+	bp := BatchProcessor{Processor: &Processor{Bus: &b}, Window: time.Minute}
+	results := make(chan testBatchResult, 1)
+
+	processAsync(&bp, context.Background(), "http://example.com/1.jpg", results)
+
+	if m := <-b.in; m.Batch != nil {
+		t.Errorf("message: %#v; expected single request", m)
+	}
+
+	b.out <- Message{}
+
+	if r := <-results; r.err != nil {
+		t.Errorf("err: %s", r.err)
+	}
+}
+
+func TestBatchProcessorSendStopped(t *testing.T) {
+	b := testBus{
+		in:    make(chan Message),
+		out:   make(chan Message),
+		done:  make(chan struct{}),
+		hello: &Hello{Version: MultiplexedVersion, MaxBatch: 8},
+	}
+	bp := BatchProcessor{Processor: &Processor{Bus: &b}, Window: time.Minute}
+	local, cancel := context.WithCancel(context.Background())
+	batch := []queued{{Message{ID: 1}, local}, {Message{ID: 2}, context.Background()}}
+	sent := make(chan struct{})
+
+	go func() {
+		bp.send(batch)
+		close(sent)
+	}()
+
+	cancel()
+
+	select {
+	case <-sent:
+		t.Fatalf("batch dropped while a caller was still waiting")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(b.done)
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("flush hung on a closed bus")
+	}
+
+	sent = make(chan struct{})
+	b.done = nil
+
+	go func() {
+		bp.send(batch[:1])
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("flush hung after every caller gave up")
+	}
+}
@@ -0,0 +1,408 @@
+package deepbooru_ipc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"deepbooru"
+)
+
+const DefaultDialTimeout = 5 * time.Second
+const DefaultHelloTimeout = 60 * time.Second
+const MinReconnectDelay = 100 * time.Millisecond
+const MaxReconnectDelay = 10 * time.Second
+
+var ErrInvalidAddress = errors.New("invalid address")
+
+func ParseAddress(s string) (network, address string, err error) {
+	i := strings.IndexByte(s, ':')
+
+	if i < 0 {
+		return "", "", ErrInvalidAddress
+	}
+
+	network, address = s[:i], s[i+1:]
+
+	switch network {
+	case "unix", "tcp", "tcp4", "tcp6":
+	default:
+		return "", "", fmt.Errorf("%w: unsupported network %q", ErrInvalidAddress, network)
+	}
+
+	if address == "" {
+		return "", "", ErrInvalidAddress
+	}
+
+	return network, address, nil
+}
+
+type ConnBus struct {
+	sync.Mutex
+
+	Network string
+	Address string
+
+	DialTimeout  time.Duration
+	HelloTimeout time.Duration
+
+	in   chan Message
+	out  chan Message
+	done chan struct{}
+
+	conn        net.Conn
+	hello       *Hello
+	outstanding map[int64]bool
+	lost        string
+	started     bool
+}
+
+func (b *ConnBus) Run(ctx context.Context) error {
+	b.Lock()
+
+	if b.started {
+		b.Unlock()
+
+		return deepbooru.ErrAlreadyRunning
+	}
+
+	b.in = make(chan Message)
+	b.out = make(chan Message)
+	b.done = make(chan struct{})
+	b.outstanding = make(map[int64]bool)
+	b.started = true
+	in, out, done := b.in, b.out, b.done
+
+	b.Unlock()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		b.write(in, out, done)
+	}()
+
+	delay := MinReconnectDelay
+
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := b.session(ctx)
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		if time.Since(start) > MaxReconnectDelay {
+			delay = MinReconnectDelay
+		}
+
+		log.Printf("Connection to %s:%s lost, reconnecting in %s: %v", b.Network, b.Address, delay, err)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > MaxReconnectDelay {
+			delay = MaxReconnectDelay
+		}
+	}
+
+	b.Lock()
+	b.started = false
+	b.Unlock()
+
+	close(done)
+	wg.Wait()
+	close(out)
+
+	return nil
+}
+
+func (b *ConnBus) session(ctx context.Context) error {
+	timeout := b.DialTimeout
+
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, b.Network, b.Address)
+
+	if err != nil {
+		return err
+	}
+
+	raw := make(chan Message)
+	closed := make(chan error, 1)
+
+	b.Lock()
+	b.conn = conn
+	b.Unlock()
+
+	log.Printf("Connected to %s:%s", b.Network, b.Address)
+
+	go func() {
+		closed <- Decode(conn, raw)
+		close(raw)
+	}()
+
+	helloTimeout := b.HelloTimeout
+
+	if helloTimeout <= 0 {
+		helloTimeout = DefaultHelloTimeout
+	}
+
+	timer := time.NewTimer(helloTimeout)
+
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			b.disconnect(conn)
+
+			for range raw {
+			}
+
+			return ctx.Err()
+		case <-timer.C:
+			b.Lock()
+			hello := b.hello
+			b.Unlock()
+
+			if hello == nil {
+				log.Printf("%s:%s did not say hello within %s", b.Network, b.Address, helloTimeout)
+				b.disconnect(conn)
+			}
+		case m, ok := <-raw:
+			if !ok {
+				b.disconnect(conn)
+				err := <-closed
+				b.abandon(ctx, fmt.Sprintf("connection to %s:%s lost: %v", b.Network, b.Address, err))
+
+				return err
+			}
+
+			if m.Hello != nil {
+				b.greet(conn, m.Hello)
+
+				continue
+			}
+
+			b.settle(&m)
+
+			select {
+			case b.out <- m:
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+func (b *ConnBus) greet(conn net.Conn, hello *Hello) {
+	err := hello.Validate()
+
+	if err != nil {
+		log.Printf("%s:%s sent invalid hello, disconnecting: %s", b.Network, b.Address, err)
+		b.disconnect(conn)
+
+		return
+	}
+
+	log.Printf(
+		"%s:%s ready: protocol v%d, model %s %s, modes %v, max batch %d",
+		b.Network,
+		b.Address,
+		hello.Version,
+		hello.Model,
+		hello.ModelVersion,
+		hello.Modes,
+		hello.MaxBatch,
+	)
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.conn != conn {
+		return
+	}
+
+	b.hello = hello
+}
+
+func (b *ConnBus) disconnect(conn net.Conn) {
+	conn.Close()
+
+	b.Lock()
+
+	if b.conn == conn {
+		b.conn = nil
+		b.hello = nil
+	}
+
+	b.Unlock()
+}
+
+func requests(m *Message) []int64 {
+	switch {
+	case m.Batch != nil:
+		ids := make([]int64, len(m.Batch))
+
+		for i := range m.Batch {
+			ids[i] = m.Batch[i].ID
+		}
+
+		return ids
+	case m.Cancel || m.Interrupt || m.Shutdown:
+		return nil
+	}
+
+	return []int64{m.ID}
+}
+
+func (b *ConnBus) write(in <-chan Message, out chan<- Message, done <-chan struct{}) {
+	for {
+		var m Message
+
+		select {
+		case m = <-in:
+		case <-done:
+			return
+		}
+
+		b.Lock()
+		conn := b.conn
+
+		if conn != nil {
+			for _, id := range requests(&m) {
+				b.outstanding[id] = true
+			}
+		}
+
+		b.Unlock()
+
+		if conn == nil {
+			log.Printf("Dropping message (id=%d), not connected", m.ID)
+
+			for _, id := range requests(&m) {
+				select {
+				case out <- Message{ID: id, Terminated: true}:
+				case <-done:
+					return
+				}
+			}
+
+			continue
+		}
+
+		err := Encode(conn, &m)
+
+		if err != nil {
+			log.Printf("Failed to send message (id=%d): %s", m.ID, err)
+			b.disconnect(conn)
+		}
+	}
+}
+
+func (b *ConnBus) settle(m *Message) {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, id := range requests(m) {
+		delete(b.outstanding, id)
+	}
+}
+
+func (b *ConnBus) abandon(ctx context.Context, reason string) {
+	b.Lock()
+	lost := b.outstanding
+	b.outstanding = make(map[int64]bool)
+	b.lost = reason
+	b.Unlock()
+
+	for id := range lost {
+		select {
+		case b.out <- Message{ID: id, Terminated: true}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *ConnBus) Output() []string {
+	if b == nil {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.lost == "" {
+		return nil
+	}
+
+	return []string{b.lost}
+}
+
+func (b *ConnBus) Interrupt() {
+	if b == nil || !b.IsReady() {
+		return
+	}
+
+	select {
+	case b.In() <- Message{Interrupt: true}:
+	case <-b.Done():
+	}
+}
+
+func (b *ConnBus) IsReady() bool {
+	if b == nil {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	return b.started && b.conn != nil && b.hello != nil
+}
+
+func (b *ConnBus) Hello() *Hello {
+	if b == nil {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	return b.hello
+}
+
+func (b *ConnBus) In() chan<- Message {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.in
+}
+
+func (b *ConnBus) Done() <-chan struct{} {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.done
+}
+
+func (b *ConnBus) Out() <-chan Message {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.out
+}
@@ -0,0 +1,307 @@
+package deepbooru_ipc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"deepbooru"
+)
+
+type testServer struct {
+	listener net.Listener
+	conns    chan net.Conn
+}
+
+func newTestServer(t *testing.T, network, address string) *testServer {
+	listener, err := net.Listen(network, address)
+
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	s := &testServer{listener, make(chan net.Conn, 4)}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			s.conns <- conn
+		}
+	}()
+
+	t.Cleanup(func() { listener.Close() })
+
+	return s
+}
+
+func (s *testServer) accept(t *testing.T, hello string) (net.Conn, *json.Decoder) {
+	select {
+	case conn := <-s.conns:
+		if hello != "" {
+			conn.Write([]byte(hello + "\n"))
+		}
+
+		return conn, json.NewDecoder(conn)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no connection")
+	}
+
+	return nil, nil
+}
+
+func waitReady(b *ConnBus, ready bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		if b.IsReady() == ready {
+			return true
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return false
+}
+
+func runBus(t *testing.T, b *ConnBus) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- b.Run(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func testConnBus(t *testing.T, network, address string) {
+	s := newTestServer(t, network, address)
+	b := &ConnBus{Network: network, Address: s.listener.Addr().String()}
+	p := &Processor{Bus: b}
+
+	runBus(t, b)
+
+	conn, decoder := s.accept(t, `{"hello":{"version":2,"concurrency":2}}`)
+
+	if !waitReady(b, true) {
+		t.Fatalf("not ready after hello")
+	}
+
+	if capacity := p.Capacity(); capacity != 2 {
+		t.Errorf("capacity: %d; expected: 2", capacity)
+	}
+
+	go func() {
+		var m Message
+
+		if decoder.Decode(&m) == nil {
+			fmt.Fprintf(conn, `{"id":%d,"tags":[{"name":"ok","score":1}]}`+"\n", m.ID)
+		}
+	}()
+
+	tags, err := p.Process(context.Background(), context.Background(), 5*time.Second, "http://example.com/test.jpg")
+
+	if err != nil || len(tags) != 1 || tags[0].Name != "ok" {
+		t.Errorf("tags: %#v, err: %v", tags, err)
+	}
+
+	go func() {
+		var m Message
+
+		decoder.Decode(&m)
+		conn.Close()
+	}()
+
+	start := time.Now()
+	_, err = p.Process(context.Background(), context.Background(), 5*time.Second, "http://example.com/test.jpg")
+
+	if _, ok := err.(*deepbooru.TerminatedError); !ok || !errors.Is(err, deepbooru.ErrTerminated) {
+		t.Errorf("err: %v; expected a TerminatedError", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("in-flight request failed after %s; expected it to fail on disconnect", elapsed)
+	}
+
+	if !waitReady(b, false) {
+		t.Fatalf("still ready after disconnect")
+	}
+
+	_, err = p.Process(context.Background(), context.Background(), 0, "http://example.com/test.jpg")
+
+	if !errors.Is(err, deepbooru.ErrTerminated) {
+		t.Errorf("err: %v; expected: deepbooru.ErrTerminated", err)
+	}
+
+	s.accept(t, `{"hello":{"version":2}}`)
+
+	if !waitReady(b, true) {
+		t.Errorf("did not reconnect")
+	}
+}
+
+func TestConnBusStop(t *testing.T) {
+	s := newTestServer(t, "tcp", "127.0.0.1:0")
+	b := &ConnBus{Network: "tcp", Address: s.listener.Addr().String()}
+	p := &Processor{Bus: b}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- b.Run(ctx)
+	}()
+
+	s.accept(t, `{"hello":{"version":2}}`)
+
+	if !waitReady(b, true) {
+		t.Fatalf("not ready after hello")
+	}
+
+	results := make(chan error, 4)
+
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			local, stop := context.WithTimeout(context.Background(), time.Second)
+			defer stop()
+
+			_, err := p.Process(context.Background(), local, 0, "http://example.com/test.jpg")
+			results <- err
+		}()
+	}
+
+	cancel()
+	<-done
+
+	for i := 0; i < cap(results); i++ {
+		select {
+		case err := <-results:
+			if err == nil {
+				t.Errorf("request succeeded after shutdown")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request hung after shutdown")
+		}
+	}
+}
+
+func TestConnBusUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conn-bus")
+
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	testConnBus(t, "unix", filepath.Join(dir, "model.sock"))
+}
+
+func TestConnBusTCP(t *testing.T) {
+	testConnBus(t, "tcp", "127.0.0.1:0")
+}
+
+func TestConnBusInterruptAfterStop(t *testing.T) {
+	s := newTestServer(t, "tcp", "127.0.0.1:0")
+	b := &ConnBus{Network: "tcp", Address: s.listener.Addr().String()}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+
+	go func() {
+		stopped <- b.Run(ctx)
+	}()
+
+	s.accept(t, `{"hello":{"version":2}}`)
+
+	if !waitReady(b, true) {
+		t.Fatalf("not ready after hello")
+	}
+
+	cancel()
+	<-stopped
+
+	conn, peer := net.Pipe()
+
+	defer conn.Close()
+	defer peer.Close()
+
+	b.Lock()
+	b.started, b.conn, b.hello = true, conn, &Hello{Version: 2}
+	b.Unlock()
+
+	interrupted := make(chan struct{})
+
+	go func() {
+		b.Interrupt()
+		close(interrupted)
+	}()
+
+	select {
+	case <-interrupted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("interrupt hung after the bus stopped")
+	}
+}
+
+func TestConnBusInvalidHello(t *testing.T) {
+	s := newTestServer(t, "tcp", "127.0.0.1:0")
+	b := &ConnBus{Network: "tcp", Address: s.listener.Addr().String(), HelloTimeout: 50 * time.Millisecond}
+
+	runBus(t, b)
+
+	conn, _ := s.accept(t, `{"hello":{"version":99}}`)
+	buf := make([]byte, 1)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Read(buf); err == nil {
+		t.Errorf("connection was not closed after invalid hello")
+	}
+
+	conn, _ = s.accept(t, "")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Read(buf); err == nil {
+		t.Errorf("connection was not closed after hello timeout")
+	}
+
+	if b.IsReady() {
+		t.Errorf("ready without a valid hello")
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	cases := []struct {
+		s                string
+		network, address string
+		ok               bool
+	}{
+		{"unix:/run/model.sock", "unix", "/run/model.sock", true},
+		{"tcp:127.0.0.1:9000", "tcp", "127.0.0.1:9000", true},
+		{"udp:127.0.0.1:9000", "", "", false},
+		{"tcp:", "", "", false},
+		{"/run/model.sock", "", "", false},
+	}
+
+	for _, c := range cases {
+		network, address, err := ParseAddress(c.s)
+
+		if network != c.network || address != c.address || (err == nil) != c.ok {
+			t.Errorf("%s: %q %q %v", c.s, network, address, err)
+		}
+	}
+}
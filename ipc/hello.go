@@ -0,0 +1,66 @@
+package deepbooru_ipc
+
+import (
+	"errors"
+	"fmt"
+)
+
+const ProtocolVersion = 2
+const MultiplexedVersion = 2
+
+var ErrProtocol = errors.New("protocol error")
+
+type Hello struct {
+	Version      int      `json:"version"`
+	Model        string   `json:"model,omitempty"`
+	ModelVersion string   `json:"model_version,omitempty"`
+	Modes        []string `json:"modes,omitempty"`
+	MaxBatch     int      `json:"max_batch,omitempty"`
+	Concurrency  int      `json:"concurrency,omitempty"`
+}
+
+func (h *Hello) Validate() error {
+	if h == nil {
+		return fmt.Errorf("%w: missing hello", ErrProtocol)
+	}
+
+	if h.Version < 1 || h.Version > ProtocolVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrProtocol, h.Version)
+	}
+
+	if h.MaxBatch < 0 {
+		return fmt.Errorf("%w: invalid max_batch %d", ErrProtocol, h.MaxBatch)
+	}
+
+	if h.Concurrency < 0 {
+		return fmt.Errorf("%w: invalid concurrency %d", ErrProtocol, h.Concurrency)
+	}
+
+	return nil
+}
+
+func (h *Hello) Supports(mode string) bool {
+	if h == nil {
+		return false
+	}
+
+	for _, m := range h.Modes {
+		if m == mode {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *Hello) Multiplexed() bool {
+	return h != nil && h.Version >= MultiplexedVersion
+}
+
+func (h *Hello) MaxConcurrency() int {
+	if h.Multiplexed() && h.Concurrency > 1 {
+		return h.Concurrency
+	}
+
+	return 1
+}
@@ -0,0 +1,51 @@
+package deepbooru_ipc
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHelloValidate(t *testing.T) {
+	cases := []struct {
+		name  string
+		hello *Hello
+		ok    bool
+	}{
+		{"ok", &Hello{Version: 1, Modes: []string{InputURL}}, true},
+		{"unknown mode", &Hello{Version: 1, Modes: []string{"carrier-pigeon"}}, true},
+		{"nil", nil, false},
+		{"no version", &Hello{}, false},
+		{"future version", &Hello{Version: ProtocolVersion + 1}, false},
+		{"negative batch", &Hello{Version: 1, MaxBatch: -1}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.hello.Validate()
+
+			if c.ok && err != nil {
+				t.Errorf("err: %s; expected: nil", err)
+			} else if !c.ok && !errors.Is(err, ErrProtocol) {
+				t.Errorf("err: %v; expected: ErrProtocol", err)
+			}
+		})
+	}
+}
+
+func TestHelloSupports(t *testing.T) {
+	var hello *Hello
+
+	if hello.Supports(InputURL) {
+		t.Errorf("nil hello supports url")
+	}
+
+	hello = &Hello{Version: 1, Modes: []string{InputURL, InputBinary}}
+
+	if !hello.Supports(InputBinary) {
+		t.Errorf("binary not supported")
+	}
+
+	if hello.Supports(InputFile) {
+		t.Errorf("file supported")
+	}
+}
@@ -4,17 +4,40 @@ import (
 	"deepbooru"
 )
 
+const (
+	InputURL    = "url"
+	InputBinary = "binary"
+	InputFile   = "file"
+)
+
 type Message struct {
+	ID    int64           `json:"id,omitempty"`
 	URL   string          `json:"url,omitempty"`
+	Input string          `json:"input,omitempty"`
+	Size  int             `json:"size,omitempty"`
+	Path  string          `json:"path,omitempty"`
 	Tags  []deepbooru.Tag `json:"tags,omitempty"`
 	Error string          `json:"error,omitempty"`
+	Batch []Message       `json:"batch,omitempty"`
+
+	Hello     *Hello `json:"hello,omitempty"`
+	Cancel    bool   `json:"cancel,omitempty"`
+	Interrupt bool   `json:"interrupt,omitempty"`
+	Shutdown  bool   `json:"shutdown,omitempty"`
 
-	Shutdown bool `json:"shutdown,omitempty"`
+	Data       []byte `json:"-"`
+	Terminated bool   `json:"-"`
 }
 
 type Bus interface {
 	In() chan<- Message
 	Out() <-chan Message
+	Done() <-chan struct{}
 	Interrupt()
 	IsReady() bool
+	Hello() *Hello
+}
+
+type Recorder interface {
+	Output() []string
 }
@@ -3,77 +3,426 @@ package deepbooru_ipc
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"os"
+	"sync"
 	"time"
 
 	"deepbooru"
+	"deepbooru/internal/resolver"
 )
 
+const DefaultMaxSize = 32 << 20
+const MaxTerminatedOutput = 4 << 10
+
+var ErrTooLarge = fmt.Errorf("%w: too large", deepbooru.ErrInvalid)
+
 type Processor struct {
-	Bus  Bus
-	busy bool
+	sync.Mutex
+
+	Bus      Bus
+	Resolver resolver.Resolver
+	MaxSize  int64
+	TempDir  string
+
+	busy    int
+	lastID  int64
+	pending map[int64]chan Message
+	routing bool
 }
 
 func (p *Processor) setBusy(b bool) {
-	p.busy = b
+	p.Lock()
+
+	if b {
+		p.busy++
+	} else {
+		p.busy--
+	}
+
+	p.Unlock()
 }
 
 func (p *Processor) Process(global, local context.Context, timeout time.Duration, url string) ([]deepbooru.Tag, error) {
 	if !p.Bus.IsReady() {
-		return nil, deepbooru.ErrTerminated
+		return nil, p.terminated()
 	}
 
 	p.setBusy(true)
 	defer p.setBusy(false)
 
+	ctx, cancel := deadline(global, local, timeout)
+
+	defer cancel()
+
+	hello := p.Bus.Hello()
+	m, cleanup, err := p.message(ctx, hello, url)
+
+	if err != nil && ctx.Err() != nil {
+		return nil, cause(global, local)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer cleanup()
+
+	id, result := p.register()
+	m.ID = id
+
+	defer p.unregister(id)
+
+	log.Printf("Sending %.64s (id=%d, %s)", url, id, m.Input)
+	err = p.send(global, local, ctx, m)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.route()
+
+	return p.wait(global, local, ctx, id, result, func() { p.cancel(global, hello, id) })
+}
+
+func deadline(global, local context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
 	var ctx context.Context
 	var cancel context.CancelFunc
 
 	if timeout > 0 {
 		ctx, cancel = context.WithTimeout(local, timeout)
-
-		defer cancel()
 	} else {
-		ctx = context.TODO()
+		ctx, cancel = context.WithCancel(local)
 	}
 
-	log.Printf("Sending %s", url)
-	p.Bus.In() <- Message{URL: url}
-
-	for {
+	go func() {
 		select {
 		case <-global.Done():
-			p.Bus.Interrupt()
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
 
-			return nil, deepbooru.ErrTerminated
-		case <-local.Done():
-			p.Bus.Interrupt()
+func cause(global, local context.Context) error {
+	switch {
+	case global.Err() != nil:
+		return deepbooru.ErrTerminated
+	case local.Err() != nil:
+		return deepbooru.ErrCancelled
+	}
 
-			return nil, deepbooru.ErrCancelled
-		case <-ctx.Done():
-			p.Bus.Interrupt()
+	return deepbooru.ErrTimeout
+}
+
+func (p *Processor) send(global, local, ctx context.Context, m Message) error {
+	in, done := p.Bus.In(), p.Bus.Done()
+
+	select {
+	case in <- m:
+		return nil
+	default:
+	}
+
+	select {
+	case in <- m:
+		return nil
+	case <-done:
+		return p.terminated()
+	case <-global.Done():
+		return deepbooru.ErrTerminated
+	case <-local.Done():
+		return deepbooru.ErrCancelled
+	case <-ctx.Done():
+		return cause(global, local)
+	}
+}
+
+func (p *Processor) wait(global, local, ctx context.Context, id int64, result <-chan Message, cancel func()) ([]deepbooru.Tag, error) {
+	select {
+	case <-global.Done():
+		cancel()
+
+		return nil, deepbooru.ErrTerminated
+	case <-local.Done():
+		cancel()
+
+		return nil, deepbooru.ErrCancelled
+	case <-ctx.Done():
+		cancel()
+
+		return nil, cause(global, local)
+	case m, ok := <-result:
+		if !ok || m.Terminated {
+			return nil, p.terminated()
+		}
+
+		log.Printf("Recieved result (id=%d)", id)
+
+		if m.Error != "" {
+			return nil, errors.New(m.Error)
+		}
+
+		return m.Tags, nil
+	}
+}
+
+func (p *Processor) terminated() error {
+	recorder, ok := p.Bus.(Recorder)
+
+	if !ok {
+		return deepbooru.ErrTerminated
+	}
+
+	output := recorder.Output()
+
+	if len(output) == 0 {
+		return deepbooru.ErrTerminated
+	}
+
+	return &deepbooru.TerminatedError{Output: tail(output, MaxTerminatedOutput)}
+}
+
+func tail(lines []string, max int) []string {
+	size := 0
+
+	for i := len(lines) - 1; i >= 0; i-- {
+		size += len(lines[i]) + 1
+
+		if size <= max {
+			continue
+		}
+
+		if i == len(lines)-1 {
+			last := lines[i]
+
+			return []string{last[len(last)-max:]}
+		}
+
+		return lines[i+1:]
+	}
+
+	return lines
+}
+
+func (p *Processor) register() (int64, <-chan Message) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.pending == nil {
+		p.pending = make(map[int64]chan Message)
+	}
+
+	p.lastID++
+	result := make(chan Message, 1)
+	p.pending[p.lastID] = result
+
+	return p.lastID, result
+}
+
+func (p *Processor) unregister(id int64) {
+	p.Lock()
+	delete(p.pending, id)
+	p.Unlock()
+}
+
+func (p *Processor) cancel(global context.Context, hello *Hello, id int64) {
+	if !hello.Multiplexed() {
+		p.Bus.Interrupt()
 
-			return nil, deepbooru.ErrTimeout
-		case m := <-p.Bus.Out():
-			log.Printf("Recieved result")
+		return
+	}
+
+	select {
+	case p.Bus.In() <- Message{ID: id, Cancel: true}:
+	case <-p.Bus.Done():
+	case <-global.Done():
+	}
+}
+
+func (p *Processor) route() {
+	p.Lock()
+
+	if p.routing {
+		p.Unlock()
+
+		return
+	}
+
+	p.routing = true
+	out := p.Bus.Out()
+
+	p.Unlock()
+
+	go func() {
+		for m := range out {
+			p.deliver(m)
+		}
+
+		p.Lock()
+
+		for id, result := range p.pending {
+			close(result)
+			delete(p.pending, id)
+		}
+
+		p.routing = false
+
+		p.Unlock()
+	}()
+}
+
+func (p *Processor) deliver(m Message) {
+	if m.Batch != nil {
+		for i := range m.Batch {
+			p.deliver(m.Batch[i])
+		}
 
-			if m.Error != "" {
-				return nil, errors.New(m.Error)
-			} else {
-				return m.Tags, nil
-			}
+		return
+	}
+
+	p.Lock()
+
+	result, ok := p.pending[m.ID]
+
+	if !ok && m.ID == 0 && len(p.pending) == 1 && !p.Bus.Hello().Multiplexed() {
+		for id := range p.pending {
+			m.ID = id
+			result, ok = p.pending[id], true
 		}
 	}
+
+	if ok {
+		delete(p.pending, m.ID)
+	}
+
+	p.Unlock()
+
+	if !ok {
+		log.Printf("Dropping response to unknown request (id=%d)", m.ID)
+
+		return
+	}
+
+	result <- m
 }
 
 func (p *Processor) Capacity() int {
-	if p.Bus.IsReady() && !p.busy {
-		return 1
+	if !p.Bus.IsReady() {
+		return 0
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	free := p.Bus.Hello().MaxConcurrency() - p.busy
+
+	if free < 0 {
+		return 0
 	}
 
-	return 0
+	return free
 }
 
 func (p *Processor) IsReady() bool {
 	return p.Bus.IsReady()
 }
+
+func noop() {}
+
+func (p *Processor) message(ctx context.Context, hello *Hello, url string) (Message, func(), error) {
+	m := Message{URL: url}
+
+	if p.Resolver == nil {
+		return m, noop, nil
+	}
+
+	binary := hello.Supports(InputBinary)
+	file := hello.Supports(InputFile)
+
+	if !binary && !file {
+		switch resolver.Scheme(url) {
+		case "http", "https", "data":
+			return m, noop, nil
+		}
+	}
+
+	data, err := p.fetch(ctx, url)
+
+	if err != nil {
+		return m, noop, err
+	}
+
+	if binary {
+		m.Input = InputBinary
+		m.Size = len(data)
+		m.Data = data
+
+		return m, noop, nil
+	}
+
+	if !file {
+		m.URL = resolver.DataURL(http.DetectContentType(data), data)
+
+		return m, noop, nil
+	}
+
+	f, err := ioutil.TempFile(p.TempDir, "deepbooru-")
+
+	if err != nil {
+		return m, noop, err
+	}
+
+	_, err = f.Write(data)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	cleanup := func() { os.Remove(f.Name()) }
+
+	if err != nil {
+		cleanup()
+
+		return m, noop, err
+	}
+
+	m.Input = InputFile
+	m.Path = f.Name()
+
+	return m, cleanup, nil
+}
+
+func (p *Processor) fetch(ctx context.Context, url string) ([]byte, error) {
+	maxSize := p.MaxSize
+
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	r, err := p.Resolver.Resolve(ctx, url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > maxSize {
+		return nil, ErrTooLarge
+	}
+
+	return data, nil
+}
@@ -2,15 +2,24 @@ package deepbooru_ipc
 
 import (
 	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
-	//	"time"
+	"time"
 
 	"deepbooru"
+	"deepbooru/internal/resolver"
 )
 
 type testBus struct {
 	interrupts int
 	in, out    chan Message
+	done       chan struct{}
+	hello      *Hello
 }
 
 func (b *testBus) Interrupt() {
@@ -29,6 +38,30 @@ func (b *testBus) Out() <-chan Message {
 	return b.out
 }
 
+func (b *testBus) Done() <-chan struct{} {
+	return b.done
+}
+
+func (b *testBus) Hello() *Hello {
+	return b.hello
+}
+
+func respond(b *testBus) <-chan Message {
+	seen := make(chan Message, 16)
+
+	go func() {
+		for m := range b.in {
+			seen <- m
+
+			if !m.Cancel {
+				b.out <- Message{ID: m.ID}
+			}
+		}
+	}()
+
+	return seen
+}
+
 func TestProcessorProcessNotRunning(t *testing.T) {
 	b := testBus{}
 	p := Processor{Bus: &b}
@@ -115,6 +148,282 @@ func TestProcessorProcessTimeout(t *testing.T) {
 	}
 }
 
+func TestProcessorProcessResolve(t *testing.T) {
+	b := testBus{
+		in:  make(chan Message, 1),
+		out: make(chan Message, 1),
+	}
+	r := resolver.Mux{
+		"s3": resolver.ResolverFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+			if url != "s3://bucket/test.png" {
+				return nil, deepbooru.ErrNotFound
+			}
+
+			return ioutil.NopCloser(strings.NewReader("\x89PNG\r\n\x1a\n")), nil
+		}),
+	}
+	p := Processor{Bus: &b, Resolver: r}
+	seen := respond(&b)
+	cases := []struct {
+		url      string
+		expected string
+		err      error
+	}{
+		{"http://example.com/test.jpg", "http://example.com/test.jpg", nil},
+		{"data:,test", "data:,test", nil},
+		{"s3://bucket/test.png", "data:image/png;base64,iVBORw0KGgo=", nil},
+		{"s3://bucket/missing.png", "", deepbooru.ErrNotFound},
+		{"ftp://example.com/test.jpg", "", resolver.ErrUnsupportedScheme},
+	}
+
+	for _, c := range cases {
+		_, err := p.Process(context.Background(), context.Background(), 0, c.url)
+
+		if err != c.err {
+			t.Errorf("%s: err: %v; expected: %v", c.url, err, c.err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		m := <-seen
+
+		if m.URL != c.expected {
+			t.Errorf("%s: url: %s; expected: %s", c.url, m.URL, c.expected)
+		}
+	}
+}
+
+func TestProcessorProcessModes(t *testing.T) {
+	r := resolver.ResolverFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("GIF89a")), nil
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		b := testBus{
+			in:    make(chan Message, 1),
+			out:   make(chan Message, 1),
+			hello: &Hello{Version: 1, Modes: []string{InputURL, InputBinary, InputFile}},
+		}
+		p := Processor{Bus: &b, Resolver: r}
+		seen := respond(&b)
+
+		p.Process(context.Background(), context.Background(), 0, "http://example.com/test.gif")
+
+		m := <-seen
+
+		if m.Input != InputBinary || m.Size != 6 || string(m.Data) != "GIF89a" {
+			t.Errorf("message: %#v", m)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		b := testBus{
+			in:    make(chan Message, 1),
+			out:   make(chan Message),
+			hello: &Hello{Version: 1, Modes: []string{InputURL, InputFile}},
+		}
+		p := Processor{Bus: &b, Resolver: r}
+		done := make(chan bool)
+
+		go func() {
+			p.Process(context.Background(), context.Background(), 0, "http://example.com/test.gif")
+			close(done)
+		}()
+
+		m := <-b.in
+		data, err := ioutil.ReadFile(m.Path)
+
+		if m.Input != InputFile || err != nil || string(data) != "GIF89a" {
+			t.Errorf("message: %#v, data: %q, err: %v", m, data, err)
+		}
+
+		b.out <- Message{ID: m.ID}
+		<-done
+
+		_, err = os.Stat(m.Path)
+
+		if !os.IsNotExist(err) {
+			t.Errorf("temp file was not removed: %v", err)
+		}
+	})
+}
+
+func TestProcessorProcessFetchCancelled(t *testing.T) {
+	r := resolver.ResolverFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		<-ctx.Done()
+
+		return nil, ctx.Err()
+	})
+
+	for _, timeout := range []time.Duration{0, time.Hour} {
+		b := testBus{
+			in:    make(chan Message, 1),
+			out:   make(chan Message),
+			hello: &Hello{Version: 1, Modes: []string{InputURL, InputBinary}},
+		}
+		p := Processor{Bus: &b, Resolver: r}
+		global, cancelGlobal := context.WithCancel(context.Background())
+		local, cancelLocal := context.WithTimeout(context.Background(), 20*time.Millisecond)
+
+		if _, err := p.Process(global, local, timeout, "http://example.com/test.gif"); err != deepbooru.ErrCancelled {
+			t.Errorf("timeout %s: err: %v; expected: deepbooru.ErrCancelled", timeout, err)
+		}
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			cancelGlobal()
+		}()
+
+		if _, err := p.Process(global, context.Background(), timeout, "http://example.com/test.gif"); err != deepbooru.ErrTerminated {
+			t.Errorf("timeout %s: err: %v; expected: deepbooru.ErrTerminated", timeout, err)
+		}
+
+		cancelLocal()
+	}
+}
+
+func TestProcessorCancelStoppedBus(t *testing.T) {
+	b := testBus{
+		in:    make(chan Message),
+		out:   make(chan Message),
+		done:  make(chan struct{}),
+		hello: &Hello{Version: 2},
+	}
+	p := Processor{Bus: &b}
+	finished := make(chan struct{})
+
+	close(b.done)
+
+	go func() {
+		p.cancel(context.Background(), b.hello, 1)
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("cancel hung on a stopped bus")
+	}
+
+	if _, err := p.Process(context.Background(), context.Background(), 0, "http://example.com/test.jpg"); err != deepbooru.ErrTerminated {
+		t.Errorf("err: %v; expected: deepbooru.ErrTerminated", err)
+	}
+}
+
+func TestProcessorMultiplexedDropsAnonymousReply(t *testing.T) {
+	b := testBus{
+		in:    make(chan Message, 1),
+		out:   make(chan Message),
+		hello: &Hello{Version: 2},
+	}
+	p := Processor{Bus: &b}
+	id, result := p.register()
+
+	p.deliver(Message{Tags: []deepbooru.Tag{{Name: "late", Score: 1}}})
+
+	select {
+	case m := <-result:
+		t.Errorf("request %d received an anonymous reply: %#v", id, m)
+	default:
+	}
+
+	b.hello = &Hello{Version: 1}
+	p.deliver(Message{Tags: []deepbooru.Tag{{Name: "ok", Score: 1}}})
+
+	if m := <-result; m.ID != id {
+		t.Errorf("message: %#v; expected the only request of a serial child to get the reply", m)
+	}
+}
+
+func TestProcessorProcessMultiplexed(t *testing.T) {
+	b := testBus{
+		in:    make(chan Message, 3),
+		out:   make(chan Message),
+		hello: &Hello{Version: MultiplexedVersion, Concurrency: 3},
+	}
+	p := Processor{Bus: &b}
+	results := make(chan []deepbooru.Tag, 2)
+	local, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+
+	for _, url := range []string{"http://example.com/1.jpg", "http://example.com/2.jpg"} {
+		go func(url string) {
+			tags, _ := p.Process(context.Background(), context.Background(), 0, url)
+			results <- tags
+		}(url)
+	}
+
+	requests := map[string]int64{}
+
+	for i := 0; i < 2; i++ {
+		m := <-b.in
+		requests[m.URL] = m.ID
+	}
+
+	go func() {
+		_, err := p.Process(context.Background(), local, 0, "http://example.com/3.jpg")
+		cancelled <- err
+	}()
+
+	third := <-b.in
+
+	if p.Capacity() != 0 {
+		t.Errorf("capacity: %d; expected: 0", p.Capacity())
+	}
+
+	cancel()
+
+	if err := <-cancelled; err != deepbooru.ErrCancelled {
+		t.Errorf("err: %v; expected: deepbooru.ErrCancelled", err)
+	}
+
+	if m := <-b.in; !m.Cancel || m.ID != third.ID {
+		t.Errorf("message: %#v; expected cancel of %d", m, third.ID)
+	}
+
+	if b.interrupts != 0 {
+		t.Errorf("interrupted")
+	}
+
+	b.out <- Message{ID: third.ID, Error: "cancelled"}
+	b.out <- Message{ID: requests["http://example.com/2.jpg"], Tags: []deepbooru.Tag{{Name: "two", Score: 1}}}
+
+	if tags := <-results; len(tags) != 1 || tags[0].Name != "two" {
+		t.Errorf("tags: %#v; expected: two", tags)
+	}
+
+	b.out <- Message{ID: requests["http://example.com/1.jpg"], Tags: []deepbooru.Tag{{Name: "one", Score: 1}}}
+
+	if tags := <-results; len(tags) != 1 || tags[0].Name != "one" {
+		t.Errorf("tags: %#v; expected: one", tags)
+	}
+
+	if p.Capacity() != 3 {
+		t.Errorf("capacity: %d; expected: 3", p.Capacity())
+	}
+}
+
+func TestProcessorProcessOutClosed(t *testing.T) {
+	b := testBus{
+		in:  make(chan Message, 1),
+		out: make(chan Message),
+	}
+	p := Processor{Bus: &b}
+
+	go func() {
+		<-b.in
+		close(b.out)
+	}()
+
+	_, err := p.Process(context.Background(), context.Background(), 0, "http://example.com/test.jpg")
+
+	if err != deepbooru.ErrTerminated {
+		t.Errorf("err: %v; expected: deepbooru.ErrTerminated", err)
+	}
+}
+
 func TestProcessorCapacity(t *testing.T) {
 	b := testBus{}
 	p := Processor{Bus: &b}
@@ -157,3 +466,69 @@ func TestProcessorIsReady(t *testing.T) {
 		}
 	})
 }
+
+type testRecorderBus struct {
+	testBus
+}
+
+func (*testRecorderBus) Output() []string {
+	return []string{"[42 stderr] Segmentation fault"}
+}
+
+func TestProcessorTerminatedOutput(t *testing.T) {
+	b := testRecorderBus{testBus{
+		in:    make(chan Message, 1),
+		out:   make(chan Message),
+		hello: &Hello{Version: 1},
+	}}
+	p := Processor{Bus: &b}
+
+	go func() {
+		<-b.in
+		close(b.out)
+	}()
+
+	_, err := p.Process(context.Background(), context.Background(), 0, "http://example.com/1.jpg")
+
+	if !errors.Is(err, deepbooru.ErrTerminated) || !strings.Contains(err.Error(), "Segmentation fault") {
+		t.Errorf("err: %v; expected terminated with output", err)
+	}
+}
+
+func TestTail(t *testing.T) {
+	long := strings.Repeat("x", 10)
+	cases := []struct {
+		lines    []string
+		expected []string
+	}{
+		{[]string{"a", "b"}, []string{"a", "b"}},
+		{[]string{"aaaa", "bb", "cc"}, []string{"bb", "cc"}},
+		{[]string{"a", long}, []string{long[2:]}},
+	}
+
+	for _, c := range cases {
+		if lines := tail(c.lines, 8); !reflect.DeepEqual(lines, c.expected) {
+			t.Errorf("tail(%q): %q; expected: %q", c.lines, lines, c.expected)
+		}
+	}
+}
+
+func TestProcessorTerminatedMessage(t *testing.T) {
+	b := testBus{
+		in:    make(chan Message, 1),
+		out:   make(chan Message),
+		hello: &Hello{Version: 1},
+	}
+	p := Processor{Bus: &b}
+
+	go func() {
+		m := <-b.in
+		b.out <- Message{ID: m.ID, Terminated: true}
+	}()
+
+	_, err := p.Process(context.Background(), context.Background(), 0, "http://example.com/1.jpg")
+
+	if err != deepbooru.ErrTerminated {
+		t.Errorf("err: %v; expected: deepbooru.ErrTerminated", err)
+	}
+}
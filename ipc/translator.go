@@ -9,7 +9,17 @@ import (
 	"os"
 )
 
-func TranslateReader(r io.Reader, out chan<- Message) {
+type NoiseFunc func(line []byte, err error)
+
+func logNoise(line []byte, err error) {
+	log.Printf("failed to decode message: %s", err)
+}
+
+func Decode(r io.Reader, out chan<- Message) error {
+	return DecodeNoisy(r, out, logNoise)
+}
+
+func DecodeNoisy(r io.Reader, out chan<- Message, noise NoiseFunc) error {
 	var err error
 	scanner := bufio.NewScanner(r)
 
@@ -18,14 +28,48 @@ func TranslateReader(r io.Reader, out chan<- Message) {
 		err = json.Unmarshal(scanner.Bytes(), &m)
 
 		if err != nil {
-			log.Printf("failed to decode message: %s", err)
+			noise(scanner.Bytes(), err)
 			continue
 		}
 
 		out <- m
 	}
 
-	err = scanner.Err()
+	return scanner.Err()
+}
+
+func Encode(w io.Writer, m *Message) error {
+	if m.Data != nil {
+		m.Size = len(m.Data)
+	}
+
+	for i := range m.Batch {
+		if m.Batch[i].Data != nil {
+			m.Batch[i].Size = len(m.Batch[i].Data)
+		}
+	}
+
+	err := json.NewEncoder(w).Encode(m)
+
+	if err == nil && m.Data != nil {
+		_, err = w.Write(m.Data)
+	}
+
+	for i := 0; err == nil && i < len(m.Batch); i++ {
+		if m.Batch[i].Data != nil {
+			_, err = w.Write(m.Batch[i].Data)
+		}
+	}
+
+	return err
+}
+
+func TranslateReader(r io.Reader, out chan<- Message) {
+	TranslateNoisyReader(r, out, logNoise)
+}
+
+func TranslateNoisyReader(r io.Reader, out chan<- Message, noise NoiseFunc) {
+	err := DecodeNoisy(r, out, noise)
 
 	if err == nil || errors.Is(err, os.ErrClosed) {
 		return
@@ -35,11 +79,8 @@ func TranslateReader(r io.Reader, out chan<- Message) {
 }
 
 func TranslateWriter(w io.Writer, in <-chan Message) {
-	var err error
-	encoder := json.NewEncoder(w)
-
 	for m := range in {
-		err = encoder.Encode(&m)
+		err := Encode(w, &m)
 
 		if err == nil {
 			continue
@@ -13,17 +13,19 @@ var testIO = `{"url":"http://example.com/test.jpg"}
 {"tags":[{"name":"test","score":1},{"name":"half","score":0.5}]}
 {"error":"not found"}
 {"shutdown":true}
+{"hello":{"version":1,"model":"test","modes":["url","binary"],"max_batch":4}}
 `
 var testMessages = []Message{
 	Message{URL: "http://example.com/test.jpg"},
-	Message{Tags: []deepbooru.Tag{deepbooru.Tag{"test", 1.0}, deepbooru.Tag{"half", 0.5}}},
+	Message{Tags: []deepbooru.Tag{deepbooru.Tag{Name: "test", Score: 1.0}, deepbooru.Tag{Name: "half", Score: 0.5}}},
 	Message{Error: "not found"},
 	Message{Shutdown: true},
+	Message{Hello: &Hello{Version: 1, Model: "test", Modes: []string{InputURL, InputBinary}, MaxBatch: 4}},
 }
 
 func TestTranslateReaderOK(t *testing.T) {
 	buff := strings.NewReader(testIO)
-	messages := make([]Message, 0, 4)
+	messages := make([]Message, 0, len(testMessages))
 	out := make(chan Message)
 
 	go func() {
@@ -90,6 +92,27 @@ func TestTranslateWriterOK(t *testing.T) {
 	}
 }
 
+func TestTranslateWriterBinary(t *testing.T) {
+	var builder strings.Builder
+	in := make(chan Message, 2)
+
+	in <- Message{URL: "s3://bucket/test.gif", Input: InputBinary, Data: []byte("GIF89a")}
+	in <- Message{Shutdown: true}
+
+	close(in)
+
+	TranslateWriter(&builder, in)
+
+	result := builder.String()
+	expected := `{"url":"s3://bucket/test.gif","input":"binary","size":6}
+GIF89a{"shutdown":true}
+`
+
+	if result != expected {
+		t.Errorf("result: %#v, expected: %#v", result, expected)
+	}
+}
+
 type testWriter struct {
 	Error error
 	N     int
@@ -10,9 +10,11 @@ type Manager struct {
 	Authorizer Authorizer
 	BusFactory BusFactory
 	Storage    Storage
+	Registry   *Registry
 
 	TickInterval    time.Duration
 	StalledInterval time.Duration
+	NodeTimeout     time.Duration
 
 	ctx context.Context
 }
@@ -21,24 +23,24 @@ type ManagerBus struct {
 	Manager *Manager
 }
 
-func (b *ManagerBus) Beat(id int64) error {
-	return b.Manager.OnBeat(id)
+func (b *ManagerBus) Beat(id, attempt int64) error {
+	return b.Manager.OnBeat(id, attempt)
 }
 
 func (b *ManagerBus) Cancel(id int64) error {
 	return b.Manager.OnCancel(id)
 }
 
-func (b *ManagerBus) Done(id int64, tags []Tag) error {
-	return b.Manager.OnDone(id, tags)
+func (b *ManagerBus) Done(id, attempt int64, tags []Tag, failed []string) error {
+	return b.Manager.OnDone(id, attempt, tags, failed)
 }
 
-func (b *ManagerBus) Error(id int64, code ErrorCode, reason string) error {
-	return b.Manager.OnError(id, code, reason)
+func (b *ManagerBus) Error(id, attempt int64, code ErrorCode, reason string) error {
+	return b.Manager.OnError(id, attempt, code, reason)
 }
 
-func (b *ManagerBus) Deschedule(ids []int64) error {
-	return b.Manager.OnDeschedule(ids)
+func (b *ManagerBus) Deschedule(leases []Lease) error {
+	return b.Manager.OnDeschedule(leases)
 }
 
 func (*ManagerBus) Schedule(node string, tasks []Info) error {
@@ -49,8 +51,20 @@ func (*ManagerBus) WakeUp() error {
 	return nil
 }
 
-func (b *ManagerBus) WorkerStatus(node string, capacity int) error {
-	return b.Manager.OnWorkerStatus(node, capacity)
+func (b *ManagerBus) WorkerStatus(status WorkerInfo) error {
+	return b.Manager.OnWorkerStatus(status)
+}
+
+func (*ManagerBus) Reload(string) error {
+	return nil
+}
+
+func (*ManagerBus) Drain(string, bool) error {
+	return nil
+}
+
+func (*ManagerBus) Reclaim(string, []int64) error {
+	return nil
 }
 
 func NewManager(a Authorizer, bf BusFactory, s Storage) *Manager {
@@ -58,9 +72,11 @@ func NewManager(a Authorizer, bf BusFactory, s Storage) *Manager {
 		Authorizer: a,
 		BusFactory: bf,
 		Storage:    s,
+		Registry:   NewRegistry(),
 
 		TickInterval:    3 * time.Second,
 		StalledInterval: 30 * time.Second,
+		NodeTimeout:     DefaultNodeTimeout,
 	}
 }
 
@@ -105,6 +121,8 @@ func (m *Manager) Run(ctx context.Context) error {
 }
 
 func (m *Manager) tick() {
+	m.reclaim()
+
 	aborted, err := m.Storage.AbortStalled(m.StalledInterval)
 
 	if err != nil {
@@ -115,6 +133,7 @@ func (m *Manager) tick() {
 
 	for i := range aborted {
 		id := aborted[i].ID
+		m.Registry.Release(Lease{id, aborted[i].Attempt})
 		err = m.BusFactory.Publish().Cancel(id)
 
 		if err != nil {
@@ -123,7 +142,7 @@ func (m *Manager) tick() {
 			return
 		}
 
-		err = m.BusFactory.Publish().Error(id, Timeout, "timeout")
+		err = m.BusFactory.Publish().Error(id, aborted[i].Attempt, Timeout, "timeout")
 
 		if err != nil {
 			log.Printf("failed to send error event (id=%d): %s", id, err)
@@ -135,24 +154,94 @@ func (m *Manager) tick() {
 	return
 }
 
-func (m *Manager) OnBeat(id int64) error {
-	return m.Storage.Beat(id)
+func (m *Manager) reclaim() {
+	expired := m.Registry.Expire(m.NodeTimeout)
+
+	for node, leases := range expired {
+		if len(leases) == 0 {
+			continue
+		}
+
+		log.Printf("node %s stopped reporting, reclaiming %d jobs", node, len(leases))
+
+		err := m.Storage.Reset(leases)
+
+		if err != nil {
+			log.Printf("failed to reclaim jobs of node %s: %s", node, err)
+
+			continue
+		}
+
+		err = m.BusFactory.Publish().WakeUp()
+
+		if err != nil {
+			log.Printf("failed to send wake up event: %s", err)
+		}
+	}
+}
+
+func (m *Manager) reclaimFor(status WorkerInfo, n int) {
+	servable := func(id int64) bool {
+		info, err := m.Storage.Get(id)
+
+		return err == nil && info.Status == Processing && info.ServableBy(status.Capabilities)
+	}
+
+	for node, ids := range m.Registry.Reclaimable(status.Node, n, servable) {
+		log.Printf("node %s is idle, reclaiming %d queued jobs from %s", status.Node, len(ids), node)
+
+		err := m.BusFactory.Publish().Reclaim(node, ids)
+
+		if err != nil {
+			log.Printf("failed to send reclaim event to %s: %s", node, err)
+		}
+	}
+}
+
+func (m *Manager) OnBeat(id, attempt int64) error {
+	return m.stale(id, attempt, m.Storage.Beat(id, attempt))
 }
 
 func (m *Manager) OnCancel(id int64) error {
-	return m.Storage.Error(id, Canceled, "")
+	m.Registry.Drop(id)
+
+	return m.Storage.Cancel(id)
+}
+
+func (m *Manager) OnDone(id, attempt int64, tags []Tag, failed []string) error {
+	err := m.Storage.Done(id, attempt, tags, failed)
+
+	if err == nil {
+		m.Registry.Release(Lease{id, attempt})
+	}
+
+	return m.stale(id, attempt, err)
 }
 
-func (m *Manager) OnDone(id int64, tags []Tag) error {
-	return m.Storage.Done(id, tags)
+func (m *Manager) OnError(id, attempt int64, code ErrorCode, reason string) error {
+	err := m.Storage.Error(id, attempt, code, reason)
+
+	if err == nil {
+		m.Registry.Release(Lease{id, attempt})
+	}
+
+	return m.stale(id, attempt, err)
 }
 
-func (m *Manager) OnError(id int64, code ErrorCode, reason string) error {
-	return m.Storage.Error(id, code, reason)
+func (m *Manager) stale(id, attempt int64, err error) error {
+	if err == ErrStale {
+		log.Printf("ignoring update from stale attempt %d of %d", attempt, id)
+
+		return nil
+	}
+
+	return err
 }
 
-func (m *Manager) OnDeschedule(ids []int64) error {
-	err := m.Storage.Reset(ids)
+func (m *Manager) OnDeschedule(leases []Lease) error {
+	m.Registry.Release(leases...)
+
+	err := m.Storage.Reset(leases)
 
 	if err != nil {
 		return err
@@ -161,21 +250,50 @@ func (m *Manager) OnDeschedule(ids []int64) error {
 	return m.BusFactory.Publish().WakeUp()
 }
 
-func (m *Manager) OnWorkerStatus(node string, capacity int) error {
+func (m *Manager) Drain(node string, enable bool) error {
+	if _, ok := m.Registry.Node(node); !ok {
+		return ErrNotFound
+	}
+
+	return m.BusFactory.Publish().Drain(node, enable)
+}
+
+func (m *Manager) OnWorkerStatus(status WorkerInfo) error {
+	m.Registry.Seen(status)
+
+	capacity := status.Capacity
+
 	if capacity <= 0 {
 		return nil
 	}
 
-	toSchedule := capacity + capacity/3
-	todo, err := m.Storage.Pop(toSchedule)
+	toSchedule := capacity + capacity/3 - len(status.Queued)
+
+	if toSchedule <= 0 {
+		return nil
+	}
+
+	todo, err := m.Storage.Pop(toSchedule, status.Capabilities)
 
 	if err != nil {
 		return err
 	}
 
+	if len(todo) < capacity && len(status.Queued) == 0 {
+		m.reclaimFor(status, capacity-len(todo))
+	}
+
 	if len(todo) == 0 {
 		return nil
 	}
 
-	return m.BusFactory.Publish().Schedule(node, todo)
+	leases := make([]Lease, len(todo))
+
+	for i := range todo {
+		leases[i] = Lease{todo[i].ID, todo[i].Attempt}
+	}
+
+	m.Registry.Assign(status.Node, leases)
+
+	return m.BusFactory.Publish().Schedule(status.Node, todo)
 }
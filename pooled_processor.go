@@ -2,52 +2,241 @@ package deepbooru
 
 import (
 	"context"
+	"log"
+	"sync"
 	"time"
 )
 
+const DefaultHealthCheckInterval = time.Second
+
 type pooledProcessor struct {
-	pool chan Processor
-	free int
+	sync.Mutex
+
+	members  []Processor
+	idle     []Processor
+	unready  []Processor
+	waiters  []chan Processor
+	inUse    map[Processor]int
+	slots    map[Processor]int
+	checking bool
+	interval time.Duration
 }
 
 func NewPooledProcessor(processors []Processor) Processor {
-	free := len(processors)
-	pool := make(chan Processor, free)
+	return &pooledProcessor{
+		members:  processors,
+		idle:     append([]Processor(nil), processors...),
+		inUse:    make(map[Processor]int),
+		slots:    make(map[Processor]int),
+		interval: DefaultHealthCheckInterval,
+	}
+}
 
-	for _, p := range processors {
-		pool <- p
+func done(ctx context.Context) <-chan struct{} {
+	if ctx == nil {
+		return nil
 	}
 
-	return &pooledProcessor{
-		free: free,
-		pool: pool,
+	return ctx.Done()
+}
+
+func (pp *pooledProcessor) getFromPool(global, local context.Context) (Processor, error) {
+	pp.Lock()
+
+	for len(pp.idle) > 0 {
+		p := pp.idle[0]
+		pp.idle = pp.idle[1:]
+
+		if p.IsReady() {
+			pp.checkout(p)
+			pp.Unlock()
+
+			return p, nil
+		}
+
+		pp.setAside(p)
+	}
+
+	w := make(chan Processor, 1)
+	pp.waiters = append(pp.waiters, w)
+	pp.Unlock()
+
+	select {
+	case p := <-w:
+		return p, nil
+	case <-done(global):
+		pp.abandon(w)
+
+		return nil, ErrTerminated
+	case <-done(local):
+		pp.abandon(w)
+
+		return nil, ErrCancelled
 	}
 }
 
-func (pp *pooledProcessor) getFromPool() Processor {
-	p := <-pp.pool
+func (pp *pooledProcessor) abandon(w chan Processor) {
+	pp.Lock()
+	defer pp.Unlock()
 
-	pp.free--
+	for i := range pp.waiters {
+		if pp.waiters[i] == w {
+			pp.waiters = append(pp.waiters[:i], pp.waiters[i+1:]...)
+
+			return
+		}
+	}
 
-	return p
+	pp.release(<-w)
 }
 
 func (pp *pooledProcessor) returnToPool(p Processor) {
-	pp.free++
-	pp.pool <- p
+	pp.Lock()
+	pp.release(p)
+	pp.Unlock()
+}
+
+func (pp *pooledProcessor) limit(p Processor) int {
+	if pp.inUse[p] == 0 {
+		slots := p.Capacity()
+
+		if slots < 1 {
+			slots = 1
+		}
+
+		pp.slots[p] = slots
+	}
+
+	return pp.slots[p]
+}
+
+func (pp *pooledProcessor) checkout(p Processor) {
+	slots := pp.limit(p)
+	pp.inUse[p]++
+
+	if pp.inUse[p] < slots {
+		pp.put(p)
+	}
+}
+
+func (pp *pooledProcessor) release(p Processor) {
+	full := pp.inUse[p] >= pp.slots[p]
+	pp.inUse[p]--
+
+	if full {
+		pp.put(p)
+	}
+}
+
+func (pp *pooledProcessor) put(p Processor) {
+	if !p.IsReady() {
+		pp.setAside(p)
+
+		return
+	}
+
+	if len(pp.waiters) == 0 {
+		pp.idle = append(pp.idle, p)
+
+		return
+	}
+
+	w := pp.waiters[0]
+	pp.waiters = pp.waiters[1:]
+	pp.checkout(p)
+	w <- p
+}
+
+func (pp *pooledProcessor) setAside(p Processor) {
+	pp.unready = append(pp.unready, p)
+
+	if pp.checking {
+		return
+	}
+
+	log.Printf("Pooled processor is not ready, checking it in the background")
+
+	pp.checking = true
+
+	go pp.check()
+}
+
+func (pp *pooledProcessor) check() {
+	interval := pp.interval
+
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pp.Lock()
+
+		unready := pp.unready
+		pp.unready = nil
+
+		for _, p := range unready {
+			if p.IsReady() {
+				pp.put(p)
+			} else {
+				pp.unready = append(pp.unready, p)
+			}
+		}
+
+		if len(pp.unready) == 0 {
+			pp.checking = false
+			pp.Unlock()
+
+			return
+		}
+
+		pp.Unlock()
+	}
 }
 
 func (pp *pooledProcessor) Process(global, local context.Context, timeout time.Duration, url string) ([]Tag, error) {
-	p := pp.getFromPool()
+	p, err := pp.getFromPool(global, local)
+
+	if err != nil {
+		return nil, err
+	}
+
 	defer pp.returnToPool(p)
 
 	return p.Process(global, local, timeout, url)
 }
 
 func (pp *pooledProcessor) Capacity() int {
-	return pp.free
+	pp.Lock()
+	defer pp.Unlock()
+
+	free := 0
+
+	for _, p := range pp.members {
+		if p.IsReady() {
+			free += pp.limit(p) - pp.inUse[p]
+		}
+	}
+
+	return free
 }
 
 func (pp *pooledProcessor) IsReady() bool {
-	return pp != nil && pp.pool != nil
+	if pp == nil {
+		return false
+	}
+
+	pp.Lock()
+	defer pp.Unlock()
+
+	for _, p := range pp.members {
+		if p.IsReady() {
+			return true
+		}
+	}
+
+	return false
 }
@@ -139,8 +139,11 @@ func TestPooledProcessorCapacity(t *testing.T) {
 		wg.Done()
 	}()
 
-	runtime.Gosched()
-	capacity = p.Capacity()
+	deadline := time.Now().Add(5 * time.Second)
+
+	for capacity = p.Capacity(); capacity > 1 && time.Now().Before(deadline); capacity = p.Capacity() {
+		runtime.Gosched()
+	}
 
 	if capacity != 1 {
 		t.Errorf("capacity: %d; expected: 1", capacity)
@@ -185,3 +188,194 @@ func TestPooledProcessorIsReady(t *testing.T) {
 		}
 	})
 }
+
+type testHealthProcessor struct {
+	sync.Mutex
+
+	ready bool
+	name  string
+}
+
+func (p *testHealthProcessor) Process(global, local context.Context, timeout time.Duration, url string) ([]Tag, error) {
+	return []Tag{{Name: p.name, Score: 1}}, nil
+}
+
+func (p *testHealthProcessor) Capacity() int {
+	return 1
+}
+
+func (p *testHealthProcessor) IsReady() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.ready
+}
+
+func (p *testHealthProcessor) setReady(ready bool) {
+	p.Lock()
+	p.ready = ready
+	p.Unlock()
+}
+
+func TestPooledProcessorCancel(t *testing.T) {
+	xpool, pool := makeTestProcessorPool(1)
+	p := NewPooledProcessor(pool)
+	busy := make(chan struct{})
+
+	go func() {
+		p.Process(nil, nil, 0, "http://example.com")
+		close(busy)
+	}()
+
+	for p.Capacity() != 0 {
+		runtime.Gosched()
+	}
+
+	global, cancelGlobal := context.WithCancel(context.Background())
+	local, cancelLocal := context.WithTimeout(context.Background(), 20*time.Millisecond)
+
+	defer cancelLocal()
+
+	if _, err := p.Process(global, local, 0, "http://example.net"); err != ErrCancelled {
+		t.Errorf("err: %v; expected: ErrCancelled", err)
+	}
+
+	cancelGlobal()
+
+	if _, err := p.Process(global, context.Background(), 0, "http://example.net"); err != ErrTerminated {
+		t.Errorf("err: %v; expected: ErrTerminated", err)
+	}
+
+	xpool[0].results <- testProcessorResult{}
+	<-busy
+
+	if capacity := p.Capacity(); capacity != 1 {
+		t.Errorf("capacity: %d; expected: 1", capacity)
+	}
+}
+
+func TestPooledProcessorSkipsUnready(t *testing.T) {
+	unready := &testHealthProcessor{name: "unready"}
+	ready := &testHealthProcessor{name: "ready", ready: true}
+	p := NewPooledProcessor([]Processor{unready, ready})
+	p.(*pooledProcessor).interval = 10 * time.Millisecond
+
+	if capacity := p.Capacity(); capacity != 1 {
+		t.Errorf("capacity: %d; expected: 1", capacity)
+	}
+
+	for i := 0; i < 3; i++ {
+		tags, err := p.Process(nil, nil, 0, "http://example.com")
+
+		if err != nil || tags[0].Name != "ready" {
+			t.Fatalf("tags: %v, err: %v; expected the ready processor", tags, err)
+		}
+	}
+
+	unready.setReady(true)
+	deadline := time.Now().Add(5 * time.Second)
+
+	for p.Capacity() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("capacity: %d; expected the recovered processor to return to the pool", p.Capacity())
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPooledProcessorConcurrentCapacity(t *testing.T) {
+	processors := make([]Processor, 4)
+
+	for i := range processors {
+		processors[i] = &testHealthProcessor{ready: true}
+	}
+
+	p := NewPooledProcessor(processors)
+	var wg sync.WaitGroup
+
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				p.Process(context.Background(), context.Background(), 0, "http://example.com")
+
+				if capacity := p.Capacity(); capacity < 0 || capacity > 4 {
+					t.Errorf("capacity: %d", capacity)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if capacity := p.Capacity(); capacity != 4 {
+		t.Errorf("capacity: %d; expected: 4", capacity)
+	}
+}
+
+type testSlotsProcessor struct {
+	slots   int
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *testSlotsProcessor) Process(global, local context.Context, timeout time.Duration, url string) ([]Tag, error) {
+	p.started <- struct{}{}
+	<-p.release
+
+	return nil, nil
+}
+
+func (p *testSlotsProcessor) Capacity() int {
+	return p.slots
+}
+
+func (p *testSlotsProcessor) IsReady() bool {
+	return true
+}
+
+func TestPooledProcessorMemberCapacity(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	p := NewPooledProcessor([]Processor{
+		&testSlotsProcessor{slots: 4, started: started, release: release},
+		&testSlotsProcessor{slots: 2, started: started, release: release},
+	})
+
+	if capacity := p.Capacity(); capacity != 6 {
+		t.Fatalf("capacity: %d; expected: 6", capacity)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			p.Process(context.Background(), context.Background(), 0, "http://example.com")
+		}()
+
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d requests were sent to members with 6 slots", i)
+		}
+	}
+
+	if capacity := p.Capacity(); capacity != 0 {
+		t.Errorf("capacity: %d; expected: 0", capacity)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if capacity := p.Capacity(); capacity != 6 {
+		t.Errorf("capacity: %d; expected: 6", capacity)
+	}
+}
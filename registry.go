@@ -0,0 +1,254 @@
+package deepbooru
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultNodeTimeout = 30 * time.Second
+
+type NodeInfo struct {
+	WorkerInfo
+
+	LastSeen time.Time
+	Jobs     []int64
+}
+
+type node struct {
+	info       WorkerInfo
+	seen       time.Time
+	jobs       map[int64]int64
+	reclaiming map[int64]bool
+}
+
+type Registry struct {
+	sync.Mutex
+
+	nodes map[string]*node
+	owner map[int64]string
+	now   func() time.Time
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		nodes: make(map[string]*node),
+		owner: make(map[int64]string),
+		now:   time.Now,
+	}
+}
+
+func (r *Registry) get(name string) *node {
+	n, ok := r.nodes[name]
+
+	if !ok {
+		n = &node{
+			info:       WorkerInfo{Node: name},
+			jobs:       make(map[int64]int64),
+			reclaiming: make(map[int64]bool),
+		}
+		r.nodes[name] = n
+	}
+
+	return n
+}
+
+func (r *Registry) Seen(status WorkerInfo) {
+	r.Lock()
+	defer r.Unlock()
+
+	n := r.get(status.Node)
+	n.info = status
+	n.seen = r.now()
+
+	queued := make(map[int64]bool, len(status.Queued))
+
+	for _, id := range status.Queued {
+		queued[id] = true
+	}
+
+	for id := range n.reclaiming {
+		if !queued[id] {
+			delete(n.reclaiming, id)
+		}
+	}
+}
+
+func (r *Registry) Reclaimable(thief string, max int, servable func(id int64) bool) map[string][]int64 {
+	r.Lock()
+	defer r.Unlock()
+
+	victims := make([]*node, 0, len(r.nodes))
+
+	for name, n := range r.nodes {
+		if name != thief && len(n.info.Queued) > len(n.reclaiming) {
+			victims = append(victims, n)
+		}
+	}
+
+	sort.Slice(victims, func(i, j int) bool {
+		a, b := len(victims[i].info.Queued), len(victims[j].info.Queued)
+
+		if a != b {
+			return a > b
+		}
+
+		return victims[i].info.Node < victims[j].info.Node
+	})
+
+	reclaimed := make(map[string][]int64)
+
+	for _, n := range victims {
+		queued := n.info.Queued
+		limit := (len(queued)+1)/2 - len(n.reclaiming)
+
+		for i := len(queued) - 1; i >= 0 && max > 0 && limit > 0; i-- {
+			id := queued[i]
+
+			if _, ok := n.jobs[id]; !ok || n.reclaiming[id] || !servable(id) {
+				continue
+			}
+
+			n.reclaiming[id] = true
+			reclaimed[n.info.Node] = append(reclaimed[n.info.Node], id)
+			max--
+			limit--
+		}
+	}
+
+	return reclaimed
+}
+
+func (r *Registry) Assign(name string, leases []Lease) {
+	r.Lock()
+	defer r.Unlock()
+
+	n := r.get(name)
+
+	for _, lease := range leases {
+		if previous, ok := r.owner[lease.ID]; ok && previous != name {
+			r.release(lease.ID)
+		}
+
+		n.jobs[lease.ID] = lease.Attempt
+		r.owner[lease.ID] = name
+	}
+}
+
+func (r *Registry) Release(leases ...Lease) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, lease := range leases {
+		name, ok := r.owner[lease.ID]
+
+		if ok && r.nodes[name].jobs[lease.ID] == lease.Attempt {
+			r.release(lease.ID)
+		}
+	}
+}
+
+func (r *Registry) Drop(ids ...int64) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, id := range ids {
+		r.release(id)
+	}
+}
+
+func (r *Registry) release(id int64) {
+	name, ok := r.owner[id]
+
+	if !ok {
+		return
+	}
+
+	delete(r.owner, id)
+	delete(r.nodes[name].jobs, id)
+	delete(r.nodes[name].reclaiming, id)
+}
+
+func (r *Registry) Owner(id int64) (string, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	name, ok := r.owner[id]
+
+	return name, ok
+}
+
+func (r *Registry) Expire(timeout time.Duration) map[string][]Lease {
+	r.Lock()
+	defer r.Unlock()
+
+	expired := make(map[string][]Lease)
+	deadline := r.now().Add(-timeout)
+
+	for name, n := range r.nodes {
+		if n.seen.After(deadline) {
+			continue
+		}
+
+		leases := make([]Lease, 0, len(n.jobs))
+
+		for id, attempt := range n.jobs {
+			leases = append(leases, Lease{id, attempt})
+			delete(r.owner, id)
+		}
+
+		sort.Slice(leases, func(i, j int) bool { return leases[i].ID < leases[j].ID })
+
+		expired[name] = leases
+		delete(r.nodes, name)
+	}
+
+	return expired
+}
+
+func (r *Registry) info(n *node) NodeInfo {
+	info := NodeInfo{
+		WorkerInfo: n.info,
+		LastSeen:   n.seen,
+		Jobs:       make([]int64, 0, len(n.jobs)),
+	}
+
+	info.Capabilities = append([]string(nil), n.info.Capabilities...)
+	info.Queued = append([]int64(nil), n.info.Queued...)
+
+	for id := range n.jobs {
+		info.Jobs = append(info.Jobs, id)
+	}
+
+	sort.Slice(info.Jobs, func(i, j int) bool { return info.Jobs[i] < info.Jobs[j] })
+
+	return info
+}
+
+func (r *Registry) Node(name string) (NodeInfo, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	n, ok := r.nodes[name]
+
+	if !ok {
+		return NodeInfo{}, false
+	}
+
+	return r.info(n), true
+}
+
+func (r *Registry) Nodes() []NodeInfo {
+	r.Lock()
+	defer r.Unlock()
+
+	nodes := make([]NodeInfo, 0, len(r.nodes))
+
+	for _, n := range r.nodes {
+		nodes = append(nodes, r.info(n))
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+
+	return nodes
+}
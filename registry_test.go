@@ -0,0 +1,86 @@
+package deepbooru
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func leases(attempt int64, ids ...int64) []Lease {
+	result := make([]Lease, len(ids))
+
+	for i, id := range ids {
+		result[i] = Lease{id, attempt}
+	}
+
+	return result
+}
+
+func TestRegistry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewRegistry()
+	r.now = func() time.Time { return now }
+
+	r.Seen(WorkerInfo{Node: "a", Capacity: 2})
+	r.Seen(WorkerInfo{Node: "b", Capacity: 1})
+	r.Assign("a", leases(1, 1, 2, 3))
+	r.Assign("b", leases(2, 3))
+	r.Release(Lease{2, 1})
+	r.Release(Lease{3, 1})
+
+	if owner, _ := r.Owner(3); owner != "b" {
+		t.Errorf("owner: %s; expected a reassigned job to move to b", owner)
+	}
+
+	if _, ok := r.Owner(2); ok {
+		t.Errorf("released jobs should have no owner")
+	}
+
+	now = now.Add(20 * time.Second)
+	r.Seen(WorkerInfo{Node: "b", Capacity: 1})
+	now = now.Add(15 * time.Second)
+
+	expired := r.Expire(30 * time.Second)
+
+	if !reflect.DeepEqual(expired, map[string][]Lease{"a": {{1, 1}}}) {
+		t.Errorf("expired: %v", expired)
+	}
+
+	nodes := r.Nodes()
+
+	if len(nodes) != 1 || nodes[0].Node != "b" || !reflect.DeepEqual(nodes[0].Jobs, []int64{3}) {
+		t.Errorf("nodes: %+v", nodes)
+	}
+
+	if _, ok := r.Owner(1); ok {
+		t.Errorf("expired jobs should have no owner")
+	}
+}
+
+func TestRegistryReclaimable(t *testing.T) {
+	r := NewRegistry()
+	r.Seen(WorkerInfo{Node: "idle"})
+	r.Seen(WorkerInfo{Node: "busy", Queued: []int64{1, 2, 3, 4, 5}})
+	r.Seen(WorkerInfo{Node: "other", Queued: []int64{6}})
+	r.Assign("busy", leases(1, 1, 2, 3, 4, 5))
+	r.Assign("other", leases(1, 6))
+
+	servable := func(id int64) bool { return id != 4 }
+	reclaimed := r.Reclaimable("idle", 10, servable)
+	expected := map[string][]int64{"busy": {5, 3, 2}, "other": {6}}
+
+	if !reflect.DeepEqual(reclaimed, expected) {
+		t.Errorf("reclaimed: %v; expected: %v", reclaimed, expected)
+	}
+
+	if reclaimed := r.Reclaimable("idle", 10, servable); len(reclaimed) != 0 {
+		t.Errorf("reclaimed: %v; expected pending reclaims to be skipped", reclaimed)
+	}
+
+	r.Release(leases(1, 2, 3, 5)...)
+	r.Seen(WorkerInfo{Node: "busy", Queued: []int64{1}})
+
+	if reclaimed := r.Reclaimable("idle", 1, servable); !reflect.DeepEqual(reclaimed, map[string][]int64{"busy": {1}}) {
+		t.Errorf("reclaimed: %v; expected acknowledged reclaims to be forgotten", reclaimed)
+	}
+}
@@ -0,0 +1,35 @@
+package deepbooru
+
+func Capabilities(capabilities []string, model, version string) []string {
+	result := append([]string(nil), capabilities...)
+
+	if model != "" {
+		result = append(result, "model="+model)
+	}
+
+	if model != "" && version != "" {
+		result = append(result, "model="+model+"@"+version)
+	}
+
+	return result
+}
+
+func (i *Info) ServableBy(capabilities []string) bool {
+	for _, required := range i.Requires {
+		found := false
+
+		for _, c := range capabilities {
+			if c == required {
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,41 @@
+package deepbooru
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	capabilities := Capabilities([]string{"nsfw-only"}, "wd14", "v2")
+	expected := []string{"nsfw-only", "model=wd14", "model=wd14@v2"}
+
+	if !reflect.DeepEqual(capabilities, expected) {
+		t.Errorf("capabilities: %v; expected: %v", capabilities, expected)
+	}
+
+	if capabilities := Capabilities(nil, "", ""); len(capabilities) != 0 {
+		t.Errorf("capabilities: %v; expected none", capabilities)
+	}
+}
+
+func TestInfoServableBy(t *testing.T) {
+	cases := []struct {
+		requires     []string
+		capabilities []string
+		servable     bool
+	}{
+		{nil, nil, true},
+		{nil, []string{"model=wd14"}, true},
+		{[]string{"model=wd14"}, nil, false},
+		{[]string{"model=wd14"}, []string{"model=deepdanbooru", "model=wd14"}, true},
+		{[]string{"model=wd14", "nsfw-only"}, []string{"model=wd14"}, false},
+	}
+
+	for _, c := range cases {
+		info := Info{Requires: c.requires}
+
+		if servable := info.ServableBy(c.capabilities); servable != c.servable {
+			t.Errorf("%v by %v: %v; expected: %v", c.requires, c.capabilities, servable, c.servable)
+		}
+	}
+}
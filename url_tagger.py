@@ -1,26 +1,51 @@
 #!/usr/bin/env python
 
+import argparse
+import base64
+import binascii
 import json
 import re
 import signal
+import socketserver
 import sys
-import time
+import threading
 import random
 from urllib.parse import urlparse
 
+HELLO = {
+    "version": 2,
+    "model": "url_tagger",
+    "model_version": "1",
+    "modes": ["url", "binary", "file"],
+    "max_batch": 8,
+    "concurrency": 4,
+}
+MAGIC = [
+    (b"\x89PNG\r\n\x1a\n", "image/png"),
+    (b"\xff\xd8\xff", "image/jpeg"),
+    (b"GIF8", "image/gif"),
+    (b"RIFF", "image/webp"),
+]
 
-def error(msg):
-    print(json.dumps({"error": msg}))
 
+class Channel:
+    def __init__(self, rfile, wfile):
+        self.rfile = rfile
+        self.wfile = wfile
+        self.lock = threading.Lock()
 
-def result(tags):
-    print(json.dumps({"tags": [
-        {
-            "name": tag,
-            "score": score
-        }
-        for tag, score in tags.items()
-    ]}))
+    def send(self, msg, id=0):
+        if id:
+            msg["id"] = id
+
+        data = (json.dumps(msg) + "\n").encode()
+
+        with self.lock:
+            self.wfile.write(data)
+            self.wfile.flush()
+
+    def error(self, msg, id=0):
+        self.send({"error": msg}, id)
 
 
 def get_ext(path):
@@ -30,58 +55,241 @@ def get_ext(path):
         return "none"
 
 
-def main():
-    alive = True
+def get_mime(data):
+    for magic, mime in MAGIC:
+        if data.startswith(magic):
+            return mime
 
-    def handle_sigterm(_, __):
-        nonlocal alive
-        alive = False
+    return "application/octet-stream"
 
-    signal.signal(signal.SIGTERM, handle_sigterm)
 
-    while alive:
+def parse_data_url(url):
+    header, _, payload = url[len("data:"):].partition(",")
+
+    if header.endswith(";base64"):
+        return header[:-len(";base64")], base64.b64decode(payload + "==")
+
+    return header, payload.encode()
+
+
+def read_payload(rfile, data):
+    mode = data.get("input", "url")
+
+    if mode == "binary":
+        size = data.get("size", 0)
+        payload = rfile.read(size)
+
+        if len(payload) != size:
+            raise EOFError()
+
+        return payload
+
+    if mode == "file":
+        with open(data.get("path", ""), "rb") as f:
+            return f.read()
+
+    return None
+
+
+def identify(url, payload):
+    if payload is not None:
+        return {
+            "input:bytes": 1,
+            "mime:" + get_mime(payload): 1,
+            "size:" + str(len(payload)): 1,
+        }
+
+    if url.startswith("data:"):
+        mediatype, payload = parse_data_url(url)
+
+        return {
+            "scheme:data": 1,
+            "mime:" + (mediatype or "none"): 1,
+            "size:" + str(len(payload)): 1,
+        }
+
+    if re.match("^https?://.*", url) is not None:
+        scheme, netloc, path, params, query, fragment = urlparse(url)
+
+        return {
+            "scheme:" + scheme: 1,
+            "host:" + netloc: 1,
+            "ext:" + get_ext(path): 1,
+        }
+
+    return None
+
+
+def prepare(rfile, data):
+    payload = read_payload(rfile, data)
+    url = data.get("url", "")
+
+    if not url and payload is None:
+        raise ValueError("missing url")
+
+    try:
+        tags = identify(url, payload)
+    except (binascii.Error, ValueError):
+        tags = None
+
+    if tags is None:
+        raise ValueError("invalid url")
+
+    return tags
+
+
+def process(channel, items, inflight):
+    r = random.random()
+    delay = 18 if r > 0.75 else (r * 3 + 2)
+    results = []
+
+    for id, tags, cancelled in items:
+        if isinstance(tags, str):
+            results.append({"id": id, "error": tags})
+        elif cancelled.wait(delay):
+            results.append({"id": id, "error": "cancelled"})
+        else:
+            results.append({"id": id, "tags": [
+                {"name": tag, "score": score}
+                for tag, score in tags.items()
+            ]})
+
+        delay = 0
+        inflight.pop(id, None)
+
+    try:
+        if len(results) == 1:
+            channel.send(results[0])
+        else:
+            channel.send({"batch": results})
+    except (BrokenPipeError, ConnectionError, ValueError):
+        pass
+
+
+def serve(channel):
+    inflight = {}
+
+    def cancel_all():
+        for cancelled in list(inflight.values()):
+            cancelled.set()
+
+    channel.send({"hello": HELLO})
+
+    while True:
         try:
-            line = input()
-        except (EOFError, BrokenPipeError):
+            line = channel.rfile.readline()
+        except (BrokenPipeError, ConnectionError):
             break
         except KeyboardInterrupt:
+            cancel_all()
             continue
 
-        if line == "":
+        line = line.rstrip(b"\n")
+
+        if not line:
             break
 
         try:
             data = json.loads(line)
         except json.JSONDecodeError:
-            error("invalid json")
+            channel.error("invalid json")
             continue
 
         if "shutdown" in data:
             break
 
-        url = data.get("url", "")
-
-        if not url:
-            error("missing url")
+        if data.get("interrupt"):
+            cancel_all()
             continue
 
-        if re.match("^https?://.*", url) is None:
-            error("invalid url")
+        if data.get("cancel"):
+            id = data.get("id", 0)
+
+            if id in inflight:
+                inflight[id].set()
+
             continue
 
-        scheme, netloc, path, params, query, fragment = urlparse(url)
-        r = random.random()
+        items = []
 
         try:
-            time.sleep(18 if r > 0.75 else (r * 3 + 2))
-        except KeyboardInterrupt:
-            continue
+            for item in data.get("batch", [data]):
+                id = item.get("id", 0)
 
-        result({
-            "scheme:" + scheme: 1,
-            "host:" + netloc: 1,
-            "ext:" + get_ext(path): 1,
-        })
+                try:
+                    tags = prepare(channel.rfile, item)
+                except OSError:
+                    tags = "unreadable payload"
+                except ValueError as e:
+                    tags = str(e)
+
+                cancelled = inflight[id] = threading.Event()
+                items.append((id, tags, cancelled))
+        except EOFError:
+            break
+
+        threading.Thread(
+            target=process,
+            args=(channel, items, inflight),
+            daemon=True,
+        ).start()
+
+    cancel_all()
+
+
+class Handler(socketserver.StreamRequestHandler):
+    def handle(self):
+        serve(Channel(self.rfile, self.wfile))
+
+
+class UnixServer(socketserver.ThreadingMixIn, socketserver.UnixStreamServer):
+    daemon_threads = True
+
+
+class TCPServer(socketserver.ThreadingMixIn, socketserver.TCPServer):
+    daemon_threads = True
+    allow_reuse_address = True
+
+
+def listen(address):
+    network, _, address = address.partition(":")
+
+    if network == "unix":
+        return UnixServer(address, Handler)
+
+    if network == "tcp":
+        host, _, port = address.rpartition(":")
+
+        return TCPServer((host, int(port)), Handler)
+
+    raise ValueError("unsupported network: " + network)
+
+
+def main():
+    parser = argparse.ArgumentParser()
+    parser.add_argument(
+        "--listen",
+        help="serve unix:/path or tcp:host:port instead of stdio",
+    )
+    args = parser.parse_args()
+
+    def handle_sigterm(_, __):
+        raise SystemExit(0)
+
+    signal.signal(signal.SIGTERM, handle_sigterm)
+
+    if args.listen is None:
+        serve(Channel(sys.stdin.buffer, sys.stdout.buffer))
+        return
+
+    with listen(args.listen) as server:
+        # let a nurse know the server is up
+        Channel(None, sys.stdout.buffer).send({"hello": HELLO})
+
+        try:
+            server.serve_forever()
+        except KeyboardInterrupt:
+            pass
 
 
 if __name__ == "__main__":
@@ -2,13 +2,15 @@ package deepbooru
 
 import (
 	"context"
+	"errors"
 	"log"
 	"sync"
 	"time"
 )
 
 type JobContext struct {
-	ID int64
+	ID      int64
+	Attempt int64
 
 	Context context.Context
 	Cancel  context.CancelFunc
@@ -21,20 +23,36 @@ type Worker struct {
 
 	BusFactory BusFactory
 	Processor  Processor
+	Reloader   Reloader
+
+	Capabilities   []string
+	ExitAfterDrain bool
 
 	TickInterval   time.Duration
 	BeatInterval   time.Duration
 	ProcessTimeout time.Duration
 
-	jobs map[int64]JobContext
-	ctx  context.Context
+	Concurrency  int
+	QueueSize    int
+	QueueTimeout time.Duration
+
+	jobs        map[int64]JobContext
+	queue       []queuedJob
+	wake        chan struct{}
+	stop        chan struct{}
+	group       *sync.WaitGroup
+	dispatchers int
+	busy        int
+	ctx         context.Context
+	draining    bool
+	drained     chan struct{}
 }
 
 type WorkerBus struct {
 	Worker *Worker
 }
 
-func (*WorkerBus) Beat(int64) error {
+func (*WorkerBus) Beat(int64, int64) error {
 	return nil
 }
 
@@ -42,15 +60,15 @@ func (b *WorkerBus) Cancel(id int64) error {
 	return b.Worker.OnCancel(id)
 }
 
-func (*WorkerBus) Done(id int64, tags []Tag) error {
+func (*WorkerBus) Done(int64, int64, []Tag, []string) error {
 	return nil
 }
 
-func (*WorkerBus) Error(int64, ErrorCode, string) error {
+func (*WorkerBus) Error(int64, int64, ErrorCode, string) error {
 	return nil
 }
 
-func (*WorkerBus) Deschedule([]int64) error {
+func (*WorkerBus) Deschedule([]Lease) error {
 	return nil
 }
 
@@ -62,10 +80,22 @@ func (b *WorkerBus) WakeUp() error {
 	return b.Worker.OnWakeUp()
 }
 
-func (*WorkerBus) WorkerStatus(string, int) error {
+func (*WorkerBus) WorkerStatus(WorkerInfo) error {
 	return nil
 }
 
+func (b *WorkerBus) Reload(node string) error {
+	return b.Worker.OnReload(node)
+}
+
+func (b *WorkerBus) Drain(node string, enable bool) error {
+	return b.Worker.OnDrain(node, enable)
+}
+
+func (b *WorkerBus) Reclaim(node string, ids []int64) error {
+	return b.Worker.OnReclaim(node, ids)
+}
+
 func NewWorker(bf BusFactory) *Worker {
 	return &Worker{
 		BusFactory: bf,
@@ -73,6 +103,7 @@ func NewWorker(bf BusFactory) *Worker {
 		TickInterval:   10 * time.Second,
 		BeatInterval:   15 * time.Second,
 		ProcessTimeout: 60 * time.Second,
+		QueueTimeout:   DefaultQueueTimeout,
 
 		jobs: make(map[int64]JobContext),
 	}
@@ -98,7 +129,7 @@ func (w *Worker) Run(ctx context.Context) error {
 
 	defer unsubscribeJobs()
 
-	unsubscribeCancel, err := w.BusFactory.SubscribeAll(wb, false, "cancel")
+	unsubscribeCancel, err := w.BusFactory.SubscribeAll(wb, false, "cancel", "reload", "drain", "reclaim")
 
 	if err != nil {
 		return err
@@ -106,36 +137,71 @@ func (w *Worker) Run(ctx context.Context) error {
 
 	defer unsubscribeCancel()
 
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wake := make(chan struct{}, 1)
+
+	w.Lock()
 	w.ctx = ctx
+	w.wake = wake
+	w.stop = stop
+	w.group = &wg
+	w.drained = make(chan struct{})
+	drained := w.drained
+	w.Unlock()
+
+	w.grow()
+
 	ticker := time.NewTicker(w.TickInterval)
 
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ticker.C:
 			w.tick()
-		case <-ctx.Done():
-			ticker.Stop()
-			w.ctx = nil
+		case <-drained:
+			log.Printf("drained, shutting down")
+			w.shutdown(stop, &wg)
 
+			return nil
+		case <-ctx.Done():
 			log.Printf("shutting down")
-
-			w.waitForJobsToFinish()
+			w.shutdown(stop, &wg)
 
 			return nil
 		}
 	}
 }
 
-func (w *Worker) Beat(id int64) error {
-	return w.BusFactory.Publish().Beat(id)
+func (w *Worker) shutdown(stop chan struct{}, wg *sync.WaitGroup) {
+	w.Lock()
+	w.wake = nil
+	w.stop = nil
+	w.Unlock()
+
+	w.flush("shutting down", func(queuedJob) bool { return true })
+	close(stop)
+	wg.Wait()
+	w.waitForJobsToFinish()
+
+	w.Lock()
+	w.ctx = nil
+	w.group = nil
+	w.dispatchers = 0
+	w.Unlock()
+}
+
+func (w *Worker) Beat(id, attempt int64) error {
+	return w.BusFactory.Publish().Beat(id, attempt)
 }
 
-func (w *Worker) Done(id int64, tags []Tag) error {
-	return w.BusFactory.Publish().Done(id, tags)
+func (w *Worker) Done(id, attempt int64, tags []Tag, failed []string) error {
+	return w.BusFactory.Publish().Done(id, attempt, tags, failed)
 }
 
-func (w *Worker) Error(id int64, code ErrorCode, reason string) error {
-	return w.BusFactory.Publish().Error(id, code, reason)
+func (w *Worker) Error(id, attempt int64, code ErrorCode, reason string) error {
+	return w.BusFactory.Publish().Error(id, attempt, code, reason)
 }
 
 func (w *Worker) OnSchedule(node string, tasks []Info) error {
@@ -143,19 +209,56 @@ func (w *Worker) OnSchedule(node string, tasks []Info) error {
 		return nil
 	}
 
-	for i := range tasks {
-		w.process(&tasks[i])
+	rejected := w.enqueue(tasks)
+
+	if len(rejected) == 0 {
+		return nil
+	}
+
+	if w.isDraining() {
+		return w.deschedule("draining", rejected)
 	}
 
+	return w.deschedule("queue is full", rejected)
+}
+
+func (w *Worker) isDraining() bool {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.draining
+}
+
+func (w *Worker) OnReclaim(node string, ids []int64) error {
+	if node != w.Name {
+		return nil
+	}
+
+	reclaimed := make(map[int64]bool, len(ids))
+
+	for _, id := range ids {
+		reclaimed[id] = true
+	}
+
+	w.flush("reclaimed by the manager", func(job queuedJob) bool {
+		return reclaimed[job.info.ID]
+	})
+
 	return nil
 }
 
 func (w *Worker) OnCancel(id int64) error {
+	if w.dequeue(id) {
+		return nil
+	}
+
 	w.Lock()
 
 	job, ok := w.jobs[id]
 
 	if !ok {
+		w.Unlock()
+
 		return nil
 	}
 
@@ -167,11 +270,100 @@ func (w *Worker) OnCancel(id int64) error {
 }
 
 func (w *Worker) OnWakeUp() error {
+	w.grow()
+
 	return w.publishStatus()
 }
 
+func (w *Worker) OnReload(node string) error {
+	if node != "" && node != w.Name {
+		return nil
+	}
+
+	if w.Reloader == nil {
+		log.Printf("reload requested, but the processor can't be reloaded")
+
+		return nil
+	}
+
+	w.Lock()
+	ctx := w.ctx
+	w.Unlock()
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	go func() {
+		err := w.Reloader.Reload(ctx)
+
+		if err != nil {
+			log.Printf("failed to reload: %s", err)
+
+			return
+		}
+
+		err = w.publishStatus()
+
+		if err != nil {
+			log.Printf("failed to send worker status: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+func (w *Worker) OnDrain(node string, enable bool) error {
+	if node != "" && node != w.Name {
+		return nil
+	}
+
+	w.Lock()
+	changed := w.draining != enable
+	w.draining = enable
+	drained := w.drained
+	w.Unlock()
+
+	if !changed {
+		return nil
+	}
+
+	if enable {
+		log.Printf("draining")
+		w.flush("draining", func(queuedJob) bool { return true })
+	} else {
+		log.Printf("resuming")
+	}
+
+	err := w.publishStatus()
+
+	if err != nil {
+		log.Printf("failed to send worker status: %s", err)
+	}
+
+	if enable && w.ExitAfterDrain && drained != nil {
+		go w.exitWhenIdle(drained)
+	}
+
+	return nil
+}
+
+func (w *Worker) exitWhenIdle(drained chan struct{}) {
+	w.waitForJobsToFinish()
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.draining && w.drained == drained {
+		close(drained)
+		w.drained = nil
+	}
+}
+
 func (w *Worker) tick() {
 	w.gc()
+	w.expireQueued()
+	w.grow()
 
 	err := w.publishStatus()
 
@@ -179,7 +371,24 @@ func (w *Worker) tick() {
 }
 
 func (w *Worker) publishStatus() error {
-	return w.BusFactory.Publish().WorkerStatus(w.Name, w.Processor.Capacity())
+	status := WorkerInfo{
+		Node:     w.Name,
+		Capacity: w.capacity(),
+		Draining: w.isDraining(),
+		Queued:   w.queued(),
+	}
+
+	if status.Draining {
+		status.Capacity = 0
+	}
+
+	if w.Reloader != nil {
+		status.Model, status.ModelVersion = w.Reloader.Model()
+	}
+
+	status.Capabilities = Capabilities(w.Capabilities, status.Model, status.ModelVersion)
+
+	return w.BusFactory.Publish().WorkerStatus(status)
 }
 
 func (w *Worker) process(info *Info) {
@@ -195,27 +404,51 @@ func (w *Worker) process(info *Info) {
 	}
 
 	job.ID = id
+	job.Attempt = info.Attempt
 	job.Context, job.Cancel = context.WithCancel(context.Background())
 	w.jobs[id] = job
 
 	w.Unlock()
 
-	go w.startHeartbeat(id, job.Context)
+	go w.startHeartbeat(id, info.Attempt, job.Context)
 
 	tags, err := w.Processor.Process(w.ctx, job.Context, w.ProcessTimeout, info.URL)
+	reason := "terminated"
+	var terminated *TerminatedError
+
+	if errors.As(err, &terminated) {
+		err = ErrTerminated
+		reason = terminated.Error()
+	}
+
+	var partial *PartialError
+	var failed []string
+
+	if errors.As(err, &partial) && tags != nil {
+		log.Printf("%d: %s", id, err)
+
+		failed = partial.Names()
+		err = nil
+	}
 
-	switch err {
-	case nil:
-		w.Done(id, tags)
-	case ErrCancelled:
-	case ErrTimeout:
-		w.Error(id, Timeout, "timeout")
-	case ErrInvalid:
-		w.Error(id, Invalid, "invalid")
-	case ErrTerminated:
-		w.Error(id, Terminated, "terminated")
+	attempt := job.Attempt
+
+	switch {
+	case err == nil:
+		w.Done(id, attempt, tags, failed)
+	case errors.Is(err, ErrCancelled):
+	case errors.Is(err, ErrUnavailable):
+		w.deschedule(err.Error(), []Info{{ID: id, Attempt: attempt}})
+	case errors.Is(err, ErrTimeout):
+		w.Error(id, attempt, Timeout, "timeout")
+	case errors.Is(err, ErrInvalid):
+		w.Error(id, attempt, Invalid, err.Error())
+	case errors.Is(err, ErrNotFound):
+		w.Error(id, attempt, NotFound, err.Error())
+	case errors.Is(err, ErrTerminated):
+		w.Error(id, attempt, Terminated, reason)
 	default:
-		w.Error(id, InternalError, err.Error())
+		w.Error(id, attempt, InternalError, err.Error())
 	}
 
 	job.Cancel()
@@ -224,7 +457,7 @@ func (w *Worker) process(info *Info) {
 	w.Unlock()
 }
 
-func (w *Worker) startHeartbeat(id int64, ctx context.Context) {
+func (w *Worker) startHeartbeat(id, attempt int64, ctx context.Context) {
 	var err error
 	heart := time.NewTicker(w.BeatInterval)
 
@@ -235,7 +468,7 @@ func (w *Worker) startHeartbeat(id int64, ctx context.Context) {
 
 			return
 		case <-heart.C:
-			err = w.Beat(id)
+			err = w.Beat(id, attempt)
 
 			if err != nil {
 				log.Printf("failed to send heart beat for %d", id)
@@ -0,0 +1,258 @@
+package deepbooru
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const DefaultQueueTimeout = 30 * time.Second
+
+type queuedJob struct {
+	info     Info
+	queuedAt time.Time
+}
+
+func (w *Worker) concurrency() int {
+	if w.Concurrency > 0 {
+		return w.Concurrency
+	}
+
+	if c := w.Processor.Capacity(); c > 0 {
+		return c
+	}
+
+	return 1
+}
+
+func (w *Worker) grow() {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.stop == nil {
+		return
+	}
+
+	slots := w.Processor.Capacity() + w.busy
+
+	if c := w.concurrency(); c > slots {
+		slots = c
+	}
+
+	for ; w.dispatchers < slots; w.dispatchers++ {
+		w.group.Add(1)
+
+		go func(group *sync.WaitGroup, stop, wake chan struct{}) {
+			defer group.Done()
+
+			w.dispatch(stop, wake)
+		}(w.group, w.stop, w.wake)
+	}
+}
+
+func (w *Worker) capacity() int {
+	capacity := w.Processor.Capacity()
+
+	w.Lock()
+	free := w.slots() - len(w.queue)
+	w.Unlock()
+
+	if free < capacity {
+		capacity = free
+	}
+
+	if capacity < 0 {
+		return 0
+	}
+
+	return capacity
+}
+
+func (w *Worker) slots() int {
+	return w.dispatchers - w.busy + w.queueSize()
+}
+
+func (w *Worker) queueSize() int {
+	if w.QueueSize > 0 {
+		return w.QueueSize
+	}
+
+	if w.dispatchers > 0 {
+		return 2 * w.dispatchers
+	}
+
+	return 2 * w.concurrency()
+}
+
+func (w *Worker) enqueue(tasks []Info) (rejected []Info) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.wake == nil {
+		return tasks
+	}
+
+	for i := range tasks {
+		id := tasks[i].ID
+
+		if _, ok := w.jobs[id]; ok || w.isQueued(id) {
+			log.Printf("ignoring %d, already scheduled", id)
+
+			continue
+		}
+
+		if w.draining || len(w.queue) >= w.slots() {
+			rejected = append(rejected, tasks[i])
+
+			continue
+		}
+
+		w.queue = append(w.queue, queuedJob{tasks[i], time.Now()})
+		w.signal()
+	}
+
+	return rejected
+}
+
+func (w *Worker) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Worker) isQueued(id int64) bool {
+	for i := range w.queue {
+		if w.queue[i].info.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w *Worker) dequeue(id int64) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	for i := range w.queue {
+		if w.queue[i].info.ID == id {
+			w.queue = append(w.queue[:i], w.queue[i+1:]...)
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w *Worker) next() (Info, bool) {
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.queue) == 0 {
+		return Info{}, false
+	}
+
+	job := w.queue[0]
+	w.queue = w.queue[1:]
+	w.busy++
+
+	if len(w.queue) > 0 {
+		w.signal()
+	}
+
+	return job.info, true
+}
+
+func (w *Worker) dispatch(stop <-chan struct{}, wake <-chan struct{}) {
+	for {
+		info, ok := w.next()
+
+		if ok {
+			w.process(&info)
+			w.finish()
+
+			continue
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-wake:
+		}
+	}
+}
+
+func (w *Worker) finish() {
+	w.Lock()
+	w.busy--
+	w.Unlock()
+}
+
+func (w *Worker) flush(reason string, expired func(queuedJob) bool) {
+	w.Lock()
+
+	var flushed []Info
+	remaining := w.queue[:0]
+
+	for _, job := range w.queue {
+		if expired(job) {
+			flushed = append(flushed, job.info)
+		} else {
+			remaining = append(remaining, job)
+		}
+	}
+
+	w.queue = remaining
+	w.Unlock()
+
+	if len(flushed) == 0 {
+		return
+	}
+
+	err := w.deschedule(reason, flushed)
+
+	if err != nil {
+		log.Printf("failed to deschedule jobs: %s", err)
+	}
+}
+
+func (w *Worker) expireQueued() {
+	timeout := w.QueueTimeout
+
+	if timeout <= 0 {
+		timeout = DefaultQueueTimeout
+	}
+
+	deadline := time.Now().Add(-timeout)
+
+	w.flush("queued for too long", func(job queuedJob) bool {
+		return job.queuedAt.Before(deadline)
+	})
+}
+
+func (w *Worker) queued() []int64 {
+	w.Lock()
+	defer w.Unlock()
+
+	ids := make([]int64, len(w.queue))
+
+	for i := range w.queue {
+		ids[i] = w.queue[i].info.ID
+	}
+
+	return ids
+}
+
+func (w *Worker) deschedule(reason string, tasks []Info) error {
+	leases := make([]Lease, len(tasks))
+
+	for i := range tasks {
+		leases[i] = Lease{tasks[i].ID, tasks[i].Attempt}
+	}
+
+	log.Printf("%s, descheduling %d jobs", reason, len(leases))
+
+	return w.BusFactory.Publish().Deschedule(leases)
+}
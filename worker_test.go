@@ -0,0 +1,449 @@
+package deepbooru
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testBus struct {
+	sync.Mutex
+
+	done       []int64
+	attempts   []int64
+	errors     []int64
+	codes      []ErrorCode
+	deschedule []int64
+	statuses   []WorkerInfo
+}
+
+func (b *testBus) Beat(id, attempt int64) error {
+	return nil
+}
+
+func (b *testBus) Cancel(id int64) error {
+	return nil
+}
+
+func (b *testBus) Done(id, attempt int64, tags []Tag, failed []string) error {
+	b.Lock()
+	b.done = append(b.done, id)
+	b.attempts = append(b.attempts, attempt)
+	b.Unlock()
+
+	return nil
+}
+
+func (b *testBus) Error(id, attempt int64, code ErrorCode, reason string) error {
+	b.Lock()
+	b.errors = append(b.errors, id)
+	b.codes = append(b.codes, code)
+	b.Unlock()
+
+	return nil
+}
+
+func (b *testBus) Deschedule(leases []Lease) error {
+	b.Lock()
+
+	for _, lease := range leases {
+		b.deschedule = append(b.deschedule, lease.ID)
+	}
+
+	b.Unlock()
+
+	return nil
+}
+
+func (b *testBus) Schedule(node string, tasks []Info) error {
+	return nil
+}
+
+func (b *testBus) WakeUp() error {
+	return nil
+}
+
+func (b *testBus) WorkerStatus(status WorkerInfo) error {
+	b.Lock()
+	b.statuses = append(b.statuses, status)
+	b.Unlock()
+
+	return nil
+}
+
+func (b *testBus) Reload(node string) error {
+	return nil
+}
+
+func (b *testBus) Drain(node string, enable bool) error {
+	return nil
+}
+
+func (b *testBus) Reclaim(node string, ids []int64) error {
+	return nil
+}
+
+func (b *testBus) lastStatus() WorkerInfo {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.statuses[len(b.statuses)-1]
+}
+
+type testBusFactory struct {
+	bus *testBus
+}
+
+func (f *testBusFactory) Publish() Bus {
+	return f.bus
+}
+
+func (f *testBusFactory) SubscribeAll(bus Bus, consume bool, types ...string) (Terminator, error) {
+	return func() {}, nil
+}
+
+func (f *testBusFactory) SubscribeOne(bus Bus, consume bool, id int64, types ...string) (Terminator, error) {
+	return func() {}, nil
+}
+
+type testDrainProcessor struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *testDrainProcessor) Process(global, local context.Context, timeout time.Duration, url string) ([]Tag, error) {
+	p.started <- struct{}{}
+	<-p.release
+
+	return []Tag{{Name: url, Score: 1}}, nil
+}
+
+func (p *testDrainProcessor) Capacity() int {
+	return 1
+}
+
+func (p *testDrainProcessor) IsReady() bool {
+	return true
+}
+
+func TestWorkerDrain(t *testing.T) {
+	bus := &testBus{}
+	p := &testDrainProcessor{started: make(chan struct{}), release: make(chan struct{})}
+	w := NewWorker(&testBusFactory{bus})
+	w.Name = "node"
+	w.Processor = p
+	w.ExitAfterDrain = true
+	w.TickInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	result := make(chan error, 1)
+
+	go func() {
+		result <- w.Run(ctx)
+	}()
+
+	for !w.running() {
+		time.Sleep(time.Millisecond)
+	}
+
+	scheduled := make(chan error, 1)
+
+	go func() {
+		scheduled <- w.OnSchedule("node", []Info{{ID: 1, URL: "a", Attempt: 7}, {ID: 2, URL: "b"}, {ID: 3, URL: "c"}})
+	}()
+
+	<-p.started
+
+	w.OnDrain("other", true)
+
+	if w.isDraining() {
+		t.Fatalf("drained by a message for another node")
+	}
+
+	w.OnDrain("node", true)
+
+	if status := bus.lastStatus(); status.Capacity != 0 || !status.Draining {
+		t.Errorf("status: %+v; expected zero capacity while draining", status)
+	}
+
+	select {
+	case <-result:
+		t.Fatalf("exited before the running job finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	p.release <- struct{}{}
+
+	if err := <-scheduled; err != nil {
+		t.Errorf("err: %s", err)
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("err: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("did not exit after draining")
+	}
+
+	bus.Lock()
+	defer bus.Unlock()
+
+	if len(bus.done) != 1 || bus.done[0] != 1 || bus.attempts[0] != 7 || len(bus.deschedule) != 2 {
+		t.Errorf("done: %v, descheduled: %v; expected the job in progress to finish and the rest to be descheduled", bus.done, bus.deschedule)
+	}
+}
+
+func (w *Worker) running() bool {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.ctx != nil
+}
+
+func startWorker(t *testing.T, w *Worker) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+
+	for !w.running() {
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestWorkerQueue(t *testing.T) {
+	bus := &testBus{}
+	p := &testDrainProcessor{started: make(chan struct{}), release: make(chan struct{})}
+	w := NewWorker(&testBusFactory{bus})
+	w.Name = "node"
+	w.Processor = p
+	w.Concurrency = 1
+	w.QueueSize = 2
+	w.QueueTimeout = 20 * time.Millisecond
+	w.TickInterval = time.Hour
+
+	startWorker(t, w)
+
+	w.OnSchedule("node", []Info{{ID: 1, URL: "a"}})
+	<-p.started
+
+	err := w.OnSchedule("node", []Info{{ID: 2, URL: "b"}, {ID: 3, URL: "c"}, {ID: 4, URL: "d"}})
+
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	w.OnSchedule("node", []Info{{ID: 2, URL: "b"}})
+	w.OnCancel(3)
+	w.publishStatus()
+
+	if status := bus.lastStatus(); len(status.Queued) != 1 || status.Queued[0] != 2 {
+		t.Errorf("queued: %v; expected: [2]", status.Queued)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	w.expireQueued()
+	p.release <- struct{}{}
+
+	bus.Lock()
+	descheduled := append([]int64(nil), bus.deschedule...)
+	bus.Unlock()
+
+	if len(descheduled) != 2 || descheduled[0] != 4 || descheduled[1] != 2 {
+		t.Errorf("descheduled: %v; expected the overflow and then the expired job", descheduled)
+	}
+
+	if queued := w.queued(); len(queued) != 0 {
+		t.Errorf("queued: %v; expected an empty queue", queued)
+	}
+}
+
+func TestWorkerReclaim(t *testing.T) {
+	bus := &testBus{}
+	p := &testDrainProcessor{started: make(chan struct{}), release: make(chan struct{})}
+	w := NewWorker(&testBusFactory{bus})
+	w.Name = "node"
+	w.Processor = p
+	w.Concurrency = 1
+	w.TickInterval = time.Hour
+
+	startWorker(t, w)
+
+	w.OnSchedule("node", []Info{{ID: 1, URL: "a"}, {ID: 2, URL: "b"}, {ID: 3, URL: "c"}})
+	<-p.started
+
+	w.OnReclaim("other", []int64{2})
+	w.OnReclaim("node", []int64{1, 3})
+
+	if queued := w.queued(); len(queued) != 1 || queued[0] != 2 {
+		t.Errorf("queued: %v; expected: [2]", queued)
+	}
+
+	bus.Lock()
+	descheduled := append([]int64(nil), bus.deschedule...)
+	bus.Unlock()
+
+	if len(descheduled) != 1 || descheduled[0] != 3 {
+		t.Errorf("descheduled: %v; expected only the queued job to be acknowledged", descheduled)
+	}
+
+	p.release <- struct{}{}
+	<-p.started
+	p.release <- struct{}{}
+}
+
+type testErrorProcessor struct {
+	err error
+}
+
+func (p *testErrorProcessor) Process(global, local context.Context, timeout time.Duration, url string) ([]Tag, error) {
+	return nil, p.err
+}
+
+func (p *testErrorProcessor) Capacity() int {
+	return 1
+}
+
+func (p *testErrorProcessor) IsReady() bool {
+	return true
+}
+
+func TestWorkerProcessUnavailable(t *testing.T) {
+	bus := &testBus{}
+	w := NewWorker(&testBusFactory{bus})
+	w.Processor = &testErrorProcessor{fmt.Errorf("%w: circuit breaker is open", ErrUnavailable)}
+	w.process(&Info{ID: 1, Attempt: 3})
+
+	if len(bus.codes) != 0 || len(bus.deschedule) != 1 || bus.deschedule[0] != 1 {
+		t.Errorf("codes: %v, descheduled: %v; expected the job to be descheduled", bus.codes, bus.deschedule)
+	}
+}
+
+func TestWorkerProcessErrors(t *testing.T) {
+	cases := []struct {
+		err  error
+		code ErrorCode
+	}{
+		{fmt.Errorf("%w: 503 Service Unavailable", fmt.Errorf("%w: model server", ErrUnavailable)), OK},
+		{ErrInvalid, Invalid},
+		{fmt.Errorf("%w: forbidden", ErrInvalid), Invalid},
+		{fmt.Errorf("%w: 400 Bad Request", ErrInvalid), Invalid},
+		{fmt.Errorf("%w: missing", ErrNotFound), NotFound},
+		{fmt.Errorf("%w: 504 Gateway Timeout", ErrTimeout), Timeout},
+		{&TerminatedError{Output: []string{"oom"}}, Terminated},
+		{fmt.Errorf("boom"), InternalError},
+	}
+
+	for _, c := range cases {
+		bus := &testBus{}
+		w := NewWorker(&testBusFactory{bus})
+		w.Processor = &testErrorProcessor{c.err}
+		w.process(&Info{ID: 1, Attempt: 1})
+
+		if c.code == OK {
+			if len(bus.codes) != 0 || len(bus.deschedule) != 1 {
+				t.Errorf("%v: codes: %v, descheduled: %v; expected the job to be descheduled", c.err, bus.codes, bus.deschedule)
+			}
+
+			continue
+		}
+
+		if len(bus.codes) != 1 || bus.codes[0] != c.code {
+			t.Errorf("%v: codes: %v; expected: [%v]", c.err, bus.codes, c.code)
+		}
+	}
+}
+
+type testSlotProcessor struct {
+	sync.Mutex
+
+	slots   int
+	busy    int
+	release chan struct{}
+}
+
+func (p *testSlotProcessor) Process(global, local context.Context, timeout time.Duration, url string) ([]Tag, error) {
+	p.Lock()
+	p.busy++
+	p.Unlock()
+
+	defer func() {
+		p.Lock()
+		p.busy--
+		p.Unlock()
+	}()
+
+	select {
+	case <-p.release:
+		return []Tag{{Name: url, Score: 1}}, nil
+	case <-local.Done():
+		return nil, ErrCancelled
+	}
+}
+
+func (p *testSlotProcessor) Capacity() int {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.slots - p.busy
+}
+
+func (p *testSlotProcessor) IsReady() bool {
+	return true
+}
+
+func TestWorkerCapacity(t *testing.T) {
+	bus := &testBus{}
+	p := &testSlotProcessor{slots: 4, release: make(chan struct{})}
+	w := NewWorker(&testBusFactory{bus})
+	w.Name = "node"
+	w.Processor = p
+	w.Concurrency = 1
+	w.QueueSize = 1
+	w.TickInterval = time.Hour
+
+	startWorker(t, w)
+	t.Cleanup(func() { close(p.release) })
+
+	id := int64(0)
+
+	for round := 0; round < 5; round++ {
+		w.OnWakeUp()
+
+		status := bus.lastStatus()
+		tasks := []Info{}
+
+		for i := status.Capacity + status.Capacity/3 - len(status.Queued); i > 0; i-- {
+			id++
+			tasks = append(tasks, Info{ID: id, URL: "a"})
+		}
+
+		w.OnSchedule("node", tasks)
+	}
+
+	bus.Lock()
+	descheduled := append([]int64(nil), bus.deschedule...)
+	bus.Unlock()
+
+	if len(descheduled) != 0 || id != 5 {
+		t.Errorf("scheduled: %d, descheduled: %v; expected the worker to take exactly its slots and queue", id, descheduled)
+	}
+
+	if status := bus.lastStatus(); status.Capacity != 0 {
+		t.Errorf("capacity: %d; expected a full worker to advertise none", status.Capacity)
+	}
+}